@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// keyACLEnabled reports whether models are restricted per API key.
+func keyACLEnabled() bool {
+	return len(KEY_MODEL_ACL) > 0 || KEY_MODEL_ACL_STRICT
+}
+
+// keyAllowsModel checks KEY_MODEL_ACL. Keys without an entry may use every
+// model, or none with KEY_MODEL_ACL_STRICT; "*" in a list allows them all.
+func keyAllowsModel(key, model string) bool {
+	models, ok := KEY_MODEL_ACL[key]
+	if !ok {
+		return !KEY_MODEL_ACL_STRICT
+	}
+	return contains(models, "*") || contains(models, model)
+}
+
+// modelDenied returns why the caller of req may not use model, or "" if it
+// may. It is checked on the model a request is finally served by, after
+// routing, and on every fallback.
+func modelDenied(req *OpenAIRequest, model string) string {
+	if AUTH_MODE == "jwt" {
+		if msg := scopeDenied(req.modelScopes, model); msg != "" {
+			return msg
+		}
+	}
+	if keyACLEnabled() && !keyAllowsModel(req.apiKey, model) {
+		return fmt.Sprintf("Your API key is not allowed to use model %s", model)
+	}
+	return ""
+}
+
+// visibleModels returns the MODEL_MAP names /v1/models lists for r. With an
+// ACL the caller must authenticate and only sees its own models; ok is false
+// once an error reply has been written.
+func visibleModels(w http.ResponseWriter, r *http.Request) (names []string, ok bool) {
+	if !keyACLEnabled() {
+		return getModelNames(), true
+	}
+	key, ok := authenticate(w, r)
+	if !ok {
+		return nil, false
+	}
+	for _, name := range getModelNames() {
+		if keyAllowsModel(key, name) {
+			names = append(names, name)
+		}
+	}
+	return names, true
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// adminTestPrompt is the fixed prompt /admin/test sends upstream.
+const adminTestPrompt = "Reply with the single word: pong"
+
+// adminSnippetMax bounds the response text /admin/test reports.
+const adminSnippetMax = 200
+
+type AdminTestResult struct {
+	Model         string `json:"model"`
+	UpstreamModel string `json:"upstream_model,omitempty"`
+	OK            bool   `json:"ok"`
+	LatencyMs     int64  `json:"latency_ms"`
+	Status        int    `json:"upstream_status,omitempty"`
+	Snippet       string `json:"snippet,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// adminAuthorized checks the request's bearer token against ADMIN_KEY.
+// Admin endpoints are disabled while ADMIN_KEY is unset.
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if ADMIN_KEY == "" {
+		writeError(w, http.StatusNotFound, "admin endpoints are disabled; set ADMIN_KEY to enable them", "invalid_request_error", "")
+		return false
+	}
+	key := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(key), []byte(ADMIN_KEY)) != 1 {
+		writeError(w, http.StatusUnauthorized, "Invalid admin key", "invalid_request_error", "invalid_api_key")
+		return false
+	}
+	return true
+}
+
+// handleAdminTest sends a tiny fixed prompt for ?model= through the same
+// upstream path as a real request, without fallbacks, so both the MODEL_MAP
+// entry and upstream reachability are checked.
+func handleAdminTest(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	model := r.URL.Query().Get("model")
+	upstreamModel, ok := MODEL_MAP[model]
+	if !ok {
+		writeInvalidParam(w, "model", "model must name an entry in MODEL_MAP")
+		return
+	}
+
+	result := AdminTestResult{Model: model, UpstreamModel: upstreamModel}
+	start := time.Now()
+	snippet, err := runAdminTest(model, upstreamModel)
+	result.LatencyMs = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		var statusErr *upstreamStatusError
+		if errors.As(err, &statusErr) {
+			result.Status = statusErr.StatusCode
+		}
+	} else {
+		result.OK = true
+		result.Status = http.StatusOK
+		result.Snippet = snippet
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !result.OK {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(result)
+}
+
+func runAdminTest(model, upstreamModel string) (string, error) {
+	authToken, err := acquireAuthToken(model)
+	if err != nil {
+		return "", err
+	}
+	req := &OpenAIRequest{Model: model, Messages: []Message{{Role: "user", Content: adminTestPrompt}}}
+	resp, err := openUpstream(req, upstreamModel, authToken)
+	if err != nil {
+		var statusErr *upstreamStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized {
+			anonTokens.invalidate(authToken)
+		}
+		return "", err
+	}
+	defer resp.Body.Close()
+	content, _, err := collectCompletion(resp.Body, req)
+	if err != nil {
+		return "", err
+	}
+	if content == "" {
+		return "", errors.New("upstream returned an empty response")
+	}
+	if utf8.RuneCountInString(content) > adminSnippetMax {
+		content = string([]rune(content)[:adminSnippetMax]) + "…"
+	}
+	return content, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Limits on request metadata, as enforced by OpenAI.
+const (
+	maxMetadataPairs    = 16
+	maxMetadataKeyLen   = 64
+	maxMetadataValueLen = 512
+)
+
+// validateMetadata returns an error message for metadata over the limits,
+// or "" if it is acceptable.
+func validateMetadata(metadata map[string]string) string {
+	if len(metadata) > maxMetadataPairs {
+		return fmt.Sprintf("metadata may have at most %d keys, got %d", maxMetadataPairs, len(metadata))
+	}
+	for key, value := range metadata {
+		if len(key) > maxMetadataKeyLen {
+			return fmt.Sprintf("metadata keys may be at most %d characters", maxMetadataKeyLen)
+		}
+		if len(value) > maxMetadataValueLen {
+			return fmt.Sprintf("metadata values may be at most %d characters (key %q)", maxMetadataValueLen, key)
+		}
+	}
+	return ""
+}
+
+// AuditRecord is one line of AUDIT_LOG.
+type AuditRecord struct {
+	Time      string            `json:"time"`
+	RequestID string            `json:"request_id,omitempty"`
+	Key       string            `json:"key"`
+	Model     string            `json:"model"`
+	Status    int               `json:"status"`
+	LatencyMS int64             `json:"latency_ms"`
+	Usage     *Usage            `json:"usage,omitempty"`
+	Store     *bool             `json:"store,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+var (
+	auditMu  sync.Mutex
+	auditLog *os.File
+)
+
+func openAuditLog() error {
+	f, err := os.OpenFile(AUDIT_LOG, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	auditLog = f
+	return nil
+}
+
+// writeAudit appends the record of a finished request to AUDIT_LOG.
+func writeAudit(req *OpenAIRequest, sw *statusWriter, start time.Time) {
+	line, err := json.Marshal(AuditRecord{
+		Time:      start.UTC().Format(time.RFC3339Nano),
+		RequestID: req.requestID,
+		Key:       keyLabel(req.apiKey),
+		Model:     req.Model,
+		Status:    sw.status,
+		LatencyMS: time.Since(start).Milliseconds(),
+		Usage:     req.usage,
+		Store:     req.Store,
+		Metadata:  req.Metadata,
+	})
+	if err != nil {
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if _, err := auditLog.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit record: %v", err)
+	}
+}
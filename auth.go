@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authenticateHMAC checks a request signed with one of HMAC_KEYS:
+//
+//	Authorization: HMAC <key id>:<unix timestamp>:<hex signature>
+//
+// where the signature is HMAC-SHA256 over "<timestamp>.<body>". Timestamps
+// further than HMAC_MAX_SKEW from now are refused, which bounds replays. The
+// caller is identified as "hmac:<key id>".
+func authenticateHMAC(w http.ResponseWriter, r *http.Request) (string, bool) {
+	credentials, ok := strings.CutPrefix(r.Header.Get("Authorization"), "HMAC ")
+	parts := strings.Split(credentials, ":")
+	if !ok || len(parts) != 3 {
+		writeError(w, http.StatusUnauthorized, "Missing HMAC signature; send Authorization: HMAC <key id>:<timestamp>:<signature>", "invalid_request_error", "invalid_api_key")
+		return "", false
+	}
+	keyID, timestamp, signature := parts[0], parts[1], parts[2]
+	secret, ok := HMAC_KEYS[keyID]
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "Unknown HMAC key id", "invalid_request_error", "invalid_api_key")
+		return "", false
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil || time.Since(time.Unix(unix, 0)).Abs() > HMAC_MAX_SKEW {
+		writeError(w, http.StatusUnauthorized, fmt.Sprintf("HMAC timestamp must be a unix time within %s of the server clock", HMAC_MAX_SKEW), "invalid_request_error", "invalid_timestamp")
+		return "", false
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Failed to read request body", "invalid_request_error", "")
+		return "", false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	given, err := hex.DecodeString(signature)
+	if err != nil || !hmac.Equal(given, mac.Sum(nil)) {
+		writeError(w, http.StatusUnauthorized, "Invalid HMAC signature", "invalid_request_error", "invalid_signature")
+		return "", false
+	}
+	return "hmac:" + keyID, true
+}
+
+// authenticateJWT checks a bearer JWT signed (RS256 or ES256) by
+// JWT_PUBLIC_KEY, and its exp, nbf and, when configured, iss and aud. The
+// caller is identified as "jwt:<sub>"; which models it may use is decided
+// later by modelDenied, from the scopes requestModelScopes reads, and the
+// response caches key on both (see cacheIdentity).
+func authenticateJWT(w http.ResponseWriter, r *http.Request) (string, bool) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		writeError(w, http.StatusUnauthorized, "Missing bearer token", "invalid_request_error", "invalid_api_key")
+		return "", false
+	}
+	claims, err := verifyJWT(token)
+	if err != nil {
+		code := "invalid_token"
+		if errors.Is(err, errJWTExpired) {
+			code = "token_expired"
+		}
+		writeError(w, http.StatusUnauthorized, fmt.Sprintf("Invalid token: %v", err), "invalid_request_error", code)
+		return "", false
+	}
+	subject, _ := claims["sub"].(string)
+	return "jwt:" + subject, true
+}
+
+var errJWTExpired = errors.New("token has expired")
+
+// verifyJWT checks token's signature and time and issuer claims and returns
+// its claims.
+func verifyJWT(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("not a JWT")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, errors.New("malformed header")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := jwtPublicKey.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return nil, errors.New("signature does not verify")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 ||
+			!ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return nil, errors.New("signature does not verify")
+		}
+	default:
+		return nil, errors.New("no JWT key configured")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, errors.New("malformed claims")
+	}
+	now := float64(time.Now().Unix())
+	exp, ok := claims["exp"].(float64)
+	switch {
+	case !ok:
+		return nil, errors.New("exp claim is required")
+	case now >= exp:
+		return nil, errJWTExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now < nbf {
+		return nil, errors.New("token is not valid yet")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("sub claim is required")
+	}
+	if JWT_ISSUER != "" && claims["iss"] != JWT_ISSUER {
+		return nil, errors.New("unexpected issuer")
+	}
+	if JWT_AUDIENCE != "" && !contains(claimStrings(claims["aud"]), JWT_AUDIENCE) {
+		return nil, errors.New("unexpected audience")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// claimStrings reads a claim that may be a string, a space-separated list
+// (as in OAuth scope) or an array of strings.
+func claimStrings(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// requestModelScopes returns the JWT_SCOPE_CLAIM of a JWT caller. The
+// token was verified by authenticateJWT for this same request, so its
+// claims are only decoded here; ok is false if they cannot be.
+func requestModelScopes(r *http.Request) (scopes []string, ok bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	var claims map[string]interface{}
+	if len(parts) != 3 || decodeJWTPart(parts[1], &claims) != nil {
+		return nil, false
+	}
+	return claimStrings(claims[JWT_SCOPE_CLAIM]), true
+}
+
+// cacheIdentity is who a replayed, idempotent or coalesced response belongs
+// to. For a JWT caller that is the subject together with the token's model
+// scopes: two tokens for one subject may grant different models, and one
+// must not be served output produced for the other.
+func cacheIdentity(apiKey string, scopes []string) string {
+	if AUTH_MODE != "jwt" {
+		return apiKey
+	}
+	sorted := append([]string(nil), scopes...)
+	sort.Strings(sorted)
+	return apiKey + "\x00" + strings.Join(sorted, " ")
+}
+
+// requestCacheIdentity is cacheIdentity for a request that has not been
+// parsed yet.
+func requestCacheIdentity(r *http.Request, apiKey string) string {
+	if AUTH_MODE != "jwt" {
+		return apiKey
+	}
+	scopes, _ := requestModelScopes(r)
+	return cacheIdentity(apiKey, scopes)
+}
+
+// scopeDenied enforces the model scopes of a JWT caller: they must grant
+// "model:<name>" or "model:*". It returns an error message, or "" when the
+// model is allowed.
+func scopeDenied(scopes []string, model string) string {
+	if contains(scopes, "model:*") || contains(scopes, "model:"+model) {
+		return ""
+	}
+	return fmt.Sprintf("Your token does not grant access to model %s (needs scope model:%s)", model, model)
+}
+
+// loadJWTPublicKey parses JWT_PUBLIC_KEY, given as PEM or as the path of a
+// PEM file.
+func loadJWTPublicKey(value string) (crypto.PublicKey, error) {
+	data := []byte(value)
+	if !strings.Contains(value, "-----BEGIN") {
+		var err error
+		if data, err = os.ReadFile(value); err != nil {
+			return nil, err
+		}
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		return key, nil
+	case *ecdsa.PublicKey:
+		if key.Curve == elliptic.P256() {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported key type %T, need RSA or ECDSA P-256", key)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// BatchItem is one entry of a /v1/chat/completions/batch reply: the
+// completion on success, otherwise the error the request would have got.
+type BatchItem struct {
+	Index    int             `json:"index"`
+	Status   int             `json:"status"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    *ErrorDetail    `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Object string      `json:"object"`
+	Data   []BatchItem `json:"data"`
+}
+
+// handleBatchCompletions serves an array of independent non-streaming chat
+// requests concurrently. Each goes through the normal pipeline, including
+// the fair scheduler, so MAX_CONCURRENCY still bounds upstream work.
+func handleBatchCompletions(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not supported on this endpoint; send a POST request with a JSON array of chat completion bodies", r.Method), "invalid_request_error", "method_not_allowed")
+		return
+	}
+	apiKey, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var items []json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&items); err != nil {
+		writeError(w, http.StatusBadRequest, "Batch body must be a JSON array of chat completion requests", "invalid_request_error", "")
+		return
+	}
+	if len(items) == 0 {
+		writeError(w, http.StatusBadRequest, "Batch is empty", "invalid_request_error", "")
+		return
+	}
+	if MAX_BATCH_SIZE > 0 && len(items) > MAX_BATCH_SIZE {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Batch may not contain more than %d requests", MAX_BATCH_SIZE), "invalid_request_error", "")
+		return
+	}
+
+	results := make([]BatchItem, len(items))
+	var wg sync.WaitGroup
+	for i, item := range items {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = serveBatchItem(r, apiKey, i, item)
+		}()
+	}
+	wg.Wait()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(BatchResponse{Object: "list", Data: results})
+}
+
+func serveBatchItem(r *http.Request, apiKey string, index int, item json.RawMessage) BatchItem {
+	var req OpenAIRequest
+	if param, msg := decodeChatRequest(item, &req); msg != "" {
+		result := batchError(index, http.StatusBadRequest, "invalid_request_error", msg)
+		if param != "" {
+			result.Error.Param = &param
+		}
+		return result
+	}
+	if req.Stream != nil && *req.Stream {
+		return batchError(index, http.StatusBadRequest, "invalid_request_error", "stream is not supported in batch requests")
+	}
+	stream := false
+	req.Stream = &stream
+
+	rec := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	completeChat(rec, batchItemRequest(r, index), apiKey, &req)
+	if rec.body.Len() == 0 {
+		// The client went away before the request got a slot.
+		return batchError(index, http.StatusServiceUnavailable, "server_error", "request was not completed")
+	}
+	if rec.status == http.StatusOK {
+		return BatchItem{Index: index, Status: rec.status, Response: rec.body.Bytes()}
+	}
+	var envelope ErrorResponse
+	if err := json.Unmarshal(rec.body.Bytes(), &envelope); err != nil {
+		errType := "invalid_request_error"
+		if rec.status >= 500 {
+			errType = "server_error"
+		}
+		return batchError(index, rec.status, errType, rec.body.String())
+	}
+	return BatchItem{Index: index, Status: rec.status, Error: &envelope.Error}
+}
+
+// batchHeaders identify a single request; they are dropped from batch items,
+// which would otherwise share one conversation, idempotency entry or echo.
+var batchHeaders = []string{"X-Conversation-ID", "Idempotency-Key", "X-Debug-Echo"}
+
+// batchItemRequest is r as seen by item index: without batchHeaders, and
+// with X-Request-ID, if the client sent one, suffixed with the index.
+func batchItemRequest(r *http.Request, index int) *http.Request {
+	item := r.Clone(r.Context())
+	for _, name := range batchHeaders {
+		item.Header.Del(name)
+	}
+	if id := r.Header.Get("X-Request-ID"); id != "" {
+		item.Header.Set("X-Request-ID", id+"-"+strconv.Itoa(index))
+	}
+	return item
+}
+
+func batchError(index, status int, errType, message string) BatchItem {
+	return BatchItem{Index: index, Status: status, Error: &ErrorDetail{Message: message, Type: errType}}
+}
+
+// bufferedResponse collects a response in memory for one batch item.
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if !b.wroteHeader {
+		b.status, b.wroteHeader = status, true
+	}
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	b.wroteHeader = true
+	return b.body.Write(p)
+}
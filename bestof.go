@@ -0,0 +1,141 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// bestOfScorers rank candidate completions; higher scores win. The upstream
+// exposes no log probabilities, so only content-based heuristics exist.
+var bestOfScorers = map[string]func(content string) float64{
+	"longest":  func(content string) float64 { return float64(utf8.RuneCountInString(content)) },
+	"shortest": func(content string) float64 { return -float64(utf8.RuneCountInString(content)) },
+}
+
+type bestOfCandidate struct {
+	content       string
+	result        *upstreamResult
+	chatID        string
+	upstreamModel string
+	err           error
+	score         float64
+}
+
+// handleBestOf generates req.bestOf() completions concurrently and returns the
+// req.choices() highest scoring ones. Usage covers every candidate, because
+// every candidate was paid for upstream.
+//
+// Each candidate runs in a concurrency slot of its own: the first in the one
+// the request was admitted with, which release gives back as soon as that
+// candidate is done, and the others wait for theirs at the same priority.
+func handleBestOf(w http.ResponseWriter, req *OpenAIRequest, authToken string, priority int, release func()) {
+	candidates := make([]bestOfCandidate, req.bestOf())
+	var wg sync.WaitGroup
+	for i := range candidates {
+		wg.Add(1)
+		go func(i int, c *bestOfCandidate) {
+			defer wg.Done()
+			creq, slot := req, release
+			if i > 0 {
+				// Only the first candidate continues the X-Conversation-ID
+				// chat upstream; sharing its chat_id would interleave the
+				// candidates there.
+				extra := *req
+				extra.conversationID = ""
+				creq = &extra
+				var err error
+				if slot, err = scheduler.acquire(req.ctx, req.apiKey, priority); err != nil {
+					c.err = err
+					return
+				}
+			}
+			defer slot()
+			resp, _, err := openUpstreamWithFallback(creq, authToken)
+			if err != nil {
+				c.err = err
+				return
+			}
+			defer resp.Body.Close()
+			c.chatID = resp.Header.Get(upstreamChatIDHeader)
+			c.upstreamModel = resp.Header.Get(upstreamModelHeader)
+			c.content, c.result, c.err = collectCompletion(resp.Body, creq)
+		}(i, &candidates[i])
+	}
+	wg.Wait()
+
+	score := bestOfScorers[BEST_OF_STRATEGY]
+	var usage *Usage // nil unless the upstream reported some
+	var ok []bestOfCandidate
+	var firstErr error
+	for _, c := range candidates {
+		if c.err != nil {
+			log.Printf("best_of candidate failed: %v", c.err)
+			if firstErr == nil {
+				firstErr = c.err
+			}
+			continue
+		}
+		if u := c.result.Usage; u != nil {
+			// The prompt is processed once per candidate.
+			if usage == nil {
+				usage = &Usage{}
+			}
+			usage.PromptTokens += u.PromptTokens
+			usage.CompletionTokens += u.CompletionTokens
+			usage.TotalTokens += u.TotalTokens
+		}
+		c.score = score(c.content)
+		ok = append(ok, c)
+	}
+	if len(ok) == 0 && req.deadlineExceeded() {
+		writeDeadlineExceeded(w)
+		return
+	}
+	if len(ok) == 0 {
+		writeUpstreamError(w, firstErr)
+		return
+	}
+	sort.SliceStable(ok, func(i, j int) bool { return ok[i].score > ok[j].score })
+	ok = ok[:min(len(ok), req.choices())]
+
+	resp := OpenAIResponse{
+		ID:      newCompletionID(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Usage:   usage,
+
+		SystemFingerprint: systemFingerprint(req.Model),
+	}
+	contents := make([]string, len(ok))
+	chatIDs := make([]string, len(ok))
+	upstreamModels := make([]string, len(ok))
+	for i, c := range ok {
+		resp.Choices = append(resp.Choices, Choice{Index: i, Message: assistantMessage(c.result), Logprobs: c.result.Logprobs, FinishReason: c.result.FinishReason})
+		contents[i] = c.content
+		chatIDs[i] = c.chatID
+		upstreamModels[i] = c.upstreamModel
+	}
+	// One chat_id per returned choice, in choice order.
+	w.Header().Set(upstreamChatIDHeader, strings.Join(chatIDs, ", "))
+	if UPSTREAM_MODEL_HEADER {
+		w.Header().Set(upstreamModelHeader, strings.Join(upstreamModels, ", "))
+	}
+	if UPSTREAM_CHAT_ID_FIELD {
+		resp.UpstreamChatID = strings.Join(chatIDs, ",")
+	}
+	var results []*upstreamResult
+	for _, c := range candidates {
+		if c.err == nil {
+			results = append(results, c.result)
+		}
+	}
+	req.recordUsage(usage, results...)
+	debugLog("best_of=%d returned %d of %d successful candidates", req.bestOf(), len(ok), len(candidates))
+	writeCompletion(w, req, resp, contents)
+}
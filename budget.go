@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ModelPrice is the cost of one million prompt (input) and completion
+// (output) tokens, in whatever currency the budgets use.
+type ModelPrice struct {
+	Input  float64 `json:"input"`
+	Output float64 `json:"output"`
+}
+
+// budgetLedger tracks what each API key spent today (UTC). Keys are stored
+// by keyLabel so BUDGET_FILE holds no secrets.
+type budgetLedger struct {
+	mu    sync.Mutex
+	Day   string             `json:"day"`
+	Spent map[string]float64 `json:"spent"`
+}
+
+var budgets = &budgetLedger{Spent: map[string]float64{}}
+
+func budgetsEnabled() bool {
+	return DAILY_BUDGET > 0 || len(KEY_BUDGETS) > 0
+}
+
+// budgetFor returns the daily budget of key; 0 means unlimited.
+func budgetFor(key string) float64 {
+	if b, ok := KEY_BUDGETS[key]; ok {
+		return b
+	}
+	return DAILY_BUDGET
+}
+
+// rollover starts a new day's counters. The caller holds mu.
+func (l *budgetLedger) rollover() {
+	if today := time.Now().UTC().Format("2006-01-02"); l.Day != today {
+		l.Day, l.Spent = today, map[string]float64{}
+	}
+}
+
+// remaining returns what key may still spend today, and false if it has no
+// budget.
+func (l *budgetLedger) remaining(key string) (float64, bool) {
+	budget := budgetFor(key)
+	if budget <= 0 {
+		return 0, false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollover()
+	return budget - l.Spent[keyLabel(key)], true
+}
+
+func (l *budgetLedger) charge(key string, amount float64) {
+	if amount <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rollover()
+	l.Spent[keyLabel(key)] += amount
+	if BUDGET_FILE != "" {
+		if err := l.save(); err != nil {
+			log.Printf("Failed to save budgets to %s: %v", BUDGET_FILE, err)
+		}
+	}
+}
+
+// save writes the ledger to BUDGET_FILE. The caller holds mu.
+func (l *budgetLedger) save() error {
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	tmp := BUDGET_FILE + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, BUDGET_FILE)
+}
+
+// loadBudgets restores today's spending from BUDGET_FILE, if it exists.
+func loadBudgets() error {
+	data, err := os.ReadFile(BUDGET_FILE)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	budgets.mu.Lock()
+	defer budgets.mu.Unlock()
+	if err := json.Unmarshal(data, budgets); err != nil {
+		return err
+	}
+	if budgets.Spent == nil {
+		budgets.Spent = map[string]float64{}
+	}
+	budgets.rollover()
+	return nil
+}
+
+// checkBudget rejects the request with 429 once the key's daily budget is
+// used up, and otherwise reports what is left in X-Budget-Remaining.
+func checkBudget(w http.ResponseWriter, key string) bool {
+	left, limited := budgets.remaining(key)
+	if !limited {
+		return true
+	}
+	if left <= 0 {
+		writeError(w, http.StatusTooManyRequests, "You exceeded your daily budget; it resets at 00:00 UTC", "insufficient_quota", "insufficient_quota")
+		return false
+	}
+	w.Header().Set("X-Budget-Remaining", strconv.FormatFloat(left, 'f', 6, 64))
+	return true
+}
+
+// requestCost prices usage with MODEL_PRICES; models without a price are
+// free.
+func requestCost(model string, usage Usage) float64 {
+	price := MODEL_PRICES[model]
+	return (float64(usage.PromptTokens)*price.Input + float64(usage.CompletionTokens)*price.Output) / 1e6
+}
+
+// recordUsage reports a finished request's usage to tracing and charges it
+// to the key's budget. Without upstream usage the tokens are estimated from
+// the prompt and the output of results.
+func (req *OpenAIRequest) recordUsage(usage *Usage, results ...*upstreamResult) {
+	req.span.setUsage(usage)
+	req.usage = usage
+	if !budgetsEnabled() {
+		return
+	}
+	if usage == nil || usage.TotalTokens == 0 {
+		estimate := Usage{}
+		for _, result := range results {
+			estimate.PromptTokens += modelTokenizer(req.Model).promptTokens(req.Messages)
+			estimate.CompletionTokens += result.EstimatedOutput
+		}
+		usage = &estimate
+	}
+	budgets.charge(req.apiKey, requestCost(req.Model, *usage))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf16"
+)
+
+// responseCharsets maps the RESPONSE_CHARSET names to the highest rune
+// each can carry as a single byte.
+var responseCharsets = map[string]rune{
+	"utf-8":      0,
+	"iso-8859-1": 0xFF,
+	"us-ascii":   0x7F,
+}
+
+var charsetAliases = map[string]string{"utf8": "utf-8", "latin1": "iso-8859-1", "ascii": "us-ascii"}
+
+// withCharset labels JSON and event-stream responses with RESPONSE_CHARSET
+// and, for a charset other than UTF-8, transcodes them. Characters the
+// charset cannot hold are sent as JSON \u escapes, which is lossless since
+// outside strings JSON is plain ASCII. Other responses are left alone.
+func withCharset(next http.Handler) http.Handler {
+	if RESPONSE_CHARSET == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&charsetWriter{ResponseWriter: w, max: responseCharsets[RESPONSE_CHARSET]}, r)
+	})
+}
+
+type charsetWriter struct {
+	http.ResponseWriter
+	max         rune // 0 for UTF-8, which needs no transcoding
+	wroteHeader bool
+	transcode   bool
+	text        utf8Carry // a character split across writes
+}
+
+func (c *charsetWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		c.label()
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+// label sets the charset parameter on the responses it applies to.
+func (c *charsetWriter) label() {
+	mediaType, params, err := mime.ParseMediaType(c.Header().Get("Content-Type"))
+	if err != nil || (mediaType != "application/json" && mediaType != "text/event-stream") {
+		return
+	}
+	params["charset"] = RESPONSE_CHARSET
+	c.Header().Set("Content-Type", mime.FormatMediaType(mediaType, params))
+	if c.max > 0 {
+		c.transcode = true
+		c.Header().Del("Content-Length")
+	}
+}
+
+func (c *charsetWriter) Write(p []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.transcode {
+		return c.ResponseWriter.Write(p)
+	}
+	if _, err := c.ResponseWriter.Write(encodeCharset(c.text.push(string(p)), c.max)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *charsetWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *charsetWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// encodeCharset writes s with one byte per rune up to max, escaping the
+// rest as \uXXXX (with surrogate pairs beyond the BMP).
+func encodeCharset(s string, max rune) []byte {
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		switch {
+		case r <= max:
+			out = append(out, byte(r))
+		case r > 0xFFFF:
+			hi, lo := utf16.EncodeRune(r)
+			out = fmt.Appendf(out, `\u%04x\u%04x`, hi, lo)
+		default:
+			out = fmt.Appendf(out, `\u%04x`, r)
+		}
+	}
+	return out
+}
+
+// normalizeCharset returns the canonical RESPONSE_CHARSET name, or "" if s
+// is not supported.
+func normalizeCharset(s string) string {
+	s = strings.ToLower(s)
+	if alias, ok := charsetAliases[s]; ok {
+		s = alias
+	}
+	if _, ok := responseCharsets[s]; !ok {
+		return ""
+	}
+	return s
+}
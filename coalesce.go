@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// coalescedCall is an in-flight chat completion that identical requests
+// arriving meanwhile attach to instead of calling the upstream themselves.
+// The whole response is kept until the call finishes, so a follower that
+// joins late still gets it from the first byte.
+type coalescedCall struct {
+	mu        sync.Mutex
+	header    http.Header
+	status    int // 0 until the leader's response starts
+	body      []byte
+	done      bool
+	followers int
+	changed   chan struct{}
+}
+
+var (
+	coalesceMu    sync.Mutex
+	coalesceCalls = map[[32]byte]*coalescedCall{}
+)
+
+// serveCoalesced runs serve for the first of a set of identical concurrent
+// requests and streams the same response to the others, marked
+// X-Coalesced. Requests are identical when key, query, body and X- headers
+// (other than X-Request-ID) match.
+func serveCoalesced(w http.ResponseWriter, r *http.Request, apiKey string, serve func(http.ResponseWriter, *http.Request, string)) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Failed to read request body", "invalid_request_error", "")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	key := coalesceKey(r, apiKey, body)
+
+	coalesceMu.Lock()
+	call, found := coalesceCalls[key]
+	if found {
+		call.mu.Lock()
+		call.followers++
+		call.mu.Unlock()
+	} else {
+		call = &coalescedCall{changed: make(chan struct{})}
+		coalesceCalls[key] = call
+	}
+	coalesceMu.Unlock()
+
+	if found {
+		if call.follow(r.Context(), w) {
+			incCounter("z2api_coalesced_requests_total")
+			return
+		}
+		// The original never produced a response; serve this one for real.
+		serve(w, r, apiKey)
+		return
+	}
+	// Followers keep reading after the leader's client is gone, so the call
+	// must not end with that client.
+	serve(&coalesceWriter{ResponseWriter: w, call: call}, r.WithContext(context.WithoutCancel(r.Context())), apiKey)
+	coalesceMu.Lock()
+	delete(coalesceCalls, key)
+	coalesceMu.Unlock()
+	call.update(func() { call.done = true })
+}
+
+func coalesceKey(r *http.Request, apiKey string, body []byte) [32]byte {
+	h := sha256.New()
+	io.WriteString(h, requestCacheIdentity(r, apiKey)+"\x00"+r.URL.RawQuery+"\x00")
+	var names []string
+	for name := range r.Header {
+		if strings.HasPrefix(name, "X-") && name != "X-Request-Id" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		io.WriteString(h, name+": "+strings.Join(r.Header[name], ", ")+"\n")
+	}
+	h.Write(body)
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// update changes the call under its lock and wakes the followers.
+func (c *coalescedCall) update(change func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	change()
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// follow copies the call's response to w as it is produced. It reports
+// false, having written nothing, when the call finished without a response.
+func (c *coalescedCall) follow(ctx context.Context, w http.ResponseWriter) bool {
+	flusher, _ := w.(http.Flusher)
+	sent, started := 0, false
+	for {
+		c.mu.Lock()
+		status, header, pending, done, changed := c.status, c.header, c.body[sent:], c.done, c.changed
+		c.mu.Unlock()
+
+		if status == 0 && done {
+			return false
+		}
+		if status != 0 && !started {
+			for name, values := range header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("X-Coalesced", "true")
+			w.WriteHeader(status)
+			started = true
+		}
+		if len(pending) > 0 {
+			if _, err := w.Write(pending); err != nil {
+				return true
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+			sent += len(pending)
+			continue
+		}
+		if done {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return true
+		}
+	}
+}
+
+// coalesceWriter passes the leader's response through while recording it
+// for the followers.
+type coalesceWriter struct {
+	http.ResponseWriter
+	call        *coalescedCall
+	wroteHeader bool
+}
+
+func (cw *coalesceWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		header := cw.Header().Clone()
+		cw.call.update(func() { cw.call.status, cw.call.header = status, header })
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *coalesceWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	var followers int
+	cw.call.update(func() {
+		cw.call.body = append(cw.call.body, b...)
+		followers = cw.call.followers
+	})
+	n, err := cw.ResponseWriter.Write(b)
+	if err != nil && followers > 0 {
+		// The leader's client left, but others are still reading.
+		return len(b), nil
+	}
+	return n, err
+}
+
+func (cw *coalesceWriter) Flush() {
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *coalesceWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// upstreamGzipRejected is set once the upstream has refused a compressed
+// request body, after which UPSTREAM_GZIP is not attempted again.
+var upstreamGzipRejected atomic.Bool
+
+// gzipBody compresses an upstream request body.
+func gzipBody(data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	zw.Close()
+	return buf.Bytes()
+}
+
+// withGzip compresses responses of at least GZIP_MIN_BYTES for clients that
+// accept gzip. Event streams are never compressed, since compression would
+// hold back flushed events.
+func withGzip(next http.Handler) http.Handler {
+	if !GZIP_ENABLED {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipWriter{ResponseWriter: w, status: http.StatusOK}
+		defer gw.finish()
+		next.ServeHTTP(gw, r)
+	})
+}
+
+// acceptsGzip reports whether an Accept-Encoding value allows gzip.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter holds back the body until it knows whether to compress: once
+// GZIP_MIN_BYTES are buffered it switches to gzip, and an event stream, a
+// flush or a short body goes out as is.
+type gzipWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         []byte
+	gz          *gzip.Writer
+	passthrough bool
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if !g.wroteHeader {
+		g.status, g.wroteHeader = status, true
+	}
+	if strings.HasPrefix(g.Header().Get("Content-Type"), "text/event-stream") {
+		g.startPassthrough()
+	}
+}
+
+func (g *gzipWriter) Write(p []byte) (int, error) {
+	g.wroteHeader = true
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(p)
+	case g.passthrough:
+		return g.ResponseWriter.Write(p)
+	case strings.HasPrefix(g.Header().Get("Content-Type"), "text/event-stream") || g.Header().Get("Content-Encoding") != "":
+		g.startPassthrough()
+		return g.ResponseWriter.Write(p)
+	}
+	g.buf = append(g.buf, p...)
+	if len(g.buf) >= GZIP_MIN_BYTES {
+		if err := g.startGzip(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (g *gzipWriter) Flush() {
+	if g.gz != nil {
+		g.gz.Flush()
+	} else if !g.passthrough {
+		g.startPassthrough()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+func (g *gzipWriter) startGzip() error {
+	g.Header().Set("Content-Encoding", "gzip")
+	g.Header().Del("Content-Length")
+	g.ResponseWriter.WriteHeader(g.status)
+	g.gz = gzip.NewWriter(g.ResponseWriter)
+	_, err := g.gz.Write(g.buf)
+	g.buf = nil
+	return err
+}
+
+func (g *gzipWriter) startPassthrough() {
+	if g.passthrough || g.gz != nil {
+		return
+	}
+	g.passthrough = true
+	g.ResponseWriter.WriteHeader(g.status)
+	if len(g.buf) > 0 {
+		g.ResponseWriter.Write(g.buf)
+		g.buf = nil
+	}
+}
+
+// finish sends whatever the handler left: the end of the gzip stream, or a
+// body too short to compress.
+func (g *gzipWriter) finish() {
+	switch {
+	case g.gz != nil:
+		g.gz.Close()
+	case !g.passthrough && g.wroteHeader:
+		g.startPassthrough()
+	}
+}
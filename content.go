@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ContentPart is one element of an array-valued message content.
+type ContentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *ImageURL `json:"image_url,omitempty"`
+}
+
+type ImageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// UnmarshalJSON accepts content as a string or as an array of parts. For
+// arrays the parts are kept for the upstream and Content holds their text.
+func (m *Message) UnmarshalJSON(b []byte) error {
+	type plain Message
+	var raw struct {
+		plain
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*m = Message(raw.plain)
+	m.Annotations = nil // response-only, never sent back upstream
+	content := bytes.TrimSpace(raw.Content)
+	switch {
+	case len(content) == 0 || bytes.Equal(content, []byte("null")):
+		return nil
+	case content[0] == '[':
+		if err := json.Unmarshal(content, &m.Parts); err != nil {
+			return fmt.Errorf("invalid message content: %v", err)
+		}
+		m.Content = partsText(m.Parts)
+		return nil
+	}
+	return json.Unmarshal(content, &m.Content)
+}
+
+// MarshalJSON sends parts back out in array form.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+	if len(m.Parts) == 0 {
+		return json.Marshal(plain(m))
+	}
+	return json.Marshal(struct {
+		plain
+		Content []ContentPart `json:"content"`
+	}{plain(m), m.Parts})
+}
+
+// MarshalJSON sends a delta with parts as array-valued content; text-only
+// deltas keep string content.
+func (d Delta) MarshalJSON() ([]byte, error) {
+	type plain Delta
+	if len(d.Parts) == 0 {
+		return json.Marshal(plain(d))
+	}
+	return json.Marshal(struct {
+		plain
+		Content []ContentPart `json:"content"`
+	}{plain(d), d.Parts})
+}
+
+func partsText(parts []ContentPart) string {
+	var texts []string
+	for _, p := range parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func (m *Message) hasImages() bool {
+	return m.imageCount() > 0
+}
+
+func (m *Message) imageCount() int {
+	n := 0
+	for _, p := range m.Parts {
+		if p.Type == "image_url" {
+			n++
+		}
+	}
+	return n
+}
+
+// countImages counts the image parts across all messages.
+func countImages(messages []Message) int {
+	n := 0
+	for i := range messages {
+		n += messages[i].imageCount()
+	}
+	return n
+}
+
+// stripImages drops image parts, returning how many were removed.
+func (m *Message) stripImages() int {
+	kept := m.Parts[:0]
+	for _, p := range m.Parts {
+		if p.Type != "image_url" {
+			kept = append(kept, p)
+		}
+	}
+	removed := len(m.Parts) - len(kept)
+	m.Parts = kept
+	return removed
+}
+
+// applyImagePolicy handles image input sent to a model without the vision
+// capability, as chosen by IMAGE_ON_TEXT_MODEL. It returns an error message
+// for the client, or "" if the request may proceed.
+func applyImagePolicy(req *OpenAIRequest) string {
+	hasImages := false
+	for i := range req.Messages {
+		hasImages = hasImages || req.Messages[i].hasImages()
+	}
+	if !hasImages || modelInfo(req.Model).hasCapability("vision") {
+		return ""
+	}
+	switch IMAGE_ON_TEXT_MODEL {
+	case "strip":
+		removed := 0
+		for i := range req.Messages {
+			removed += req.Messages[i].stripImages()
+		}
+		debugLog("Stripped %d images: model %s has no vision capability", removed, req.Model)
+		return ""
+	case "route":
+		if model := visionModel(req); model != "" {
+			debugLog("Routing request with images from %s to vision model %s", req.Model, model)
+			req.Model = model
+			return ""
+		}
+		return fmt.Sprintf("Model %s does not accept images and no vision-capable model is configured", req.Model)
+	}
+	return fmt.Sprintf("Model %s does not accept images; use a vision-capable model", req.Model)
+}
+
+// visionModel is the first model, by name, with the vision capability that
+// the caller of req may use.
+func visionModel(req *OpenAIRequest) string {
+	names := getModelNames()
+	sort.Strings(names)
+	for _, name := range names {
+		if modelInfo(name).hasCapability("vision") && modelDenied(req, name) == "" {
+			return name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// conversationStore maps a client's X-Conversation-ID to the upstream
+// chat_id its turns are sent under, so a multi-turn conversation stays one
+// upstream chat. Entries expire CONVERSATION_TTL after their last use. Keys
+// are hashes of the API key and conversation id, so CONVERSATION_STORE files
+// hold no secrets.
+type conversationStore struct {
+	mu      sync.Mutex
+	path    string // "" keeps the mapping in memory only
+	entries map[string]*conversationEntry
+	version int // bumped for each snapshot taken for saving
+
+	saveMu sync.Mutex // serializes writes to path
+	saved  int        // version of the last snapshot written
+}
+
+type conversationEntry struct {
+	ChatID  string    `json:"chat_id"`
+	Expires time.Time `json:"expires"`
+}
+
+var conversations = &conversationStore{entries: map[string]*conversationEntry{}}
+
+// loadConversations switches the store to the file at path, loading the
+// mapping saved there, if any.
+func loadConversations(path string) error {
+	conversations.mu.Lock()
+	defer conversations.mu.Unlock()
+	conversations.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &conversations.entries); err != nil {
+		return err
+	}
+	conversations.prune()
+	log.Printf("Loaded %d conversations from %s", len(conversations.entries), path)
+	return nil
+}
+
+// chatID returns the upstream chat_id for the conversation, starting a new
+// one if it is unknown or expired. The store file is only rewritten when a
+// conversation starts; extended expiry times are saved along with it.
+func (s *conversationStore) chatID(apiKey, conversationID string) string {
+	sum := sha256.Sum256([]byte(apiKey + "\x00" + conversationID))
+	key := hex.EncodeToString(sum[:])
+	s.mu.Lock()
+	entry, ok := s.entries[key]
+	started := !ok || entry.Expires.Before(time.Now())
+	if started {
+		s.prune()
+		entry = &conversationEntry{ChatID: newUpstreamChatID()}
+		s.entries[key] = entry
+		debugLog("Starting upstream chat %s for conversation %q", entry.ChatID, conversationID)
+	}
+	entry.Expires = time.Now().Add(CONVERSATION_TTL)
+	chatID := entry.ChatID
+	var data []byte
+	var err error
+	if started && s.path != "" {
+		data, err = json.Marshal(s.entries)
+		s.version++
+	}
+	version := s.version
+	s.mu.Unlock()
+
+	if data != nil {
+		err = s.save(data, version)
+	}
+	if err != nil {
+		log.Printf("Failed to save conversations to %s: %v", s.path, err)
+	}
+	return chatID
+}
+
+// prune drops expired entries. The caller holds mu.
+func (s *conversationStore) prune() {
+	now := time.Now()
+	for key, entry := range s.entries {
+		if entry.Expires.Before(now) {
+			delete(s.entries, key)
+		}
+	}
+}
+
+// save writes data, the mapping as of version, to the store file unless a
+// newer snapshot got there first. It runs without mu, so requests are not
+// held up by the disk.
+func (s *conversationStore) save(data []byte, version int) error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+	if version <= s.saved {
+		return nil
+	}
+	s.saved = version
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// debugEcho is what the X-Debug-Echo response header reports about a
+// request, so a client can confirm what the proxy received.
+type debugEcho struct {
+	Headers  map[string]string `json:"headers"`
+	Model    string            `json:"model"`
+	Messages int               `json:"messages"`
+	Stream   *bool             `json:"stream"`
+	// Truncated is set when headers were left out to keep within
+	// echoMaxBytes.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// echoCredentialWords mark header names that carry credentials, such as
+// Authorization, Cookie, X-Api-Key, Api-Key or X-Upstream-Token, whichever
+// scheme the client or a gateway in front of the proxy uses. Their values
+// are never echoed.
+var echoCredentialWords = []string{"auth", "cookie", "key", "token", "secret", "password", "session", "signature"}
+
+// The echo goes into a single response header, which proxies and clients
+// limit to a few KiB: long values are cut to echoValueMax bytes, and headers
+// are dropped once the whole echo would pass echoMaxBytes.
+const (
+	echoValueMax = 256
+	echoMaxBytes = 4096
+)
+
+func echoRedacted(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range echoCredentialWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// setDebugEcho answers a request sent with X-Debug-Echo: true, under
+// DEBUG_MODE, with its headers and a summary of the parsed body in the
+// X-Debug-Echo response header.
+func setDebugEcho(w http.ResponseWriter, r *http.Request, req *OpenAIRequest) {
+	if !DEBUG_MODE || r.Header.Get("X-Debug-Echo") != "true" {
+		return
+	}
+	echo := debugEcho{Headers: map[string]string{}, Model: req.Model, Messages: len(req.Messages), Stream: req.Stream}
+	names := make([]string, 0, len(r.Header))
+	for name, values := range r.Header {
+		names = append(names, name)
+		value := strings.Join(values, ", ")
+		switch {
+		case echoRedacted(name):
+			value = "[redacted]"
+		case len(value) > echoValueMax:
+			value = strings.ToValidUTF8(value[:echoValueMax], "") + "...[truncated]"
+		}
+		echo.Headers[name] = value
+	}
+	sort.Strings(names)
+	for {
+		data, err := json.Marshal(echo)
+		if err != nil {
+			return
+		}
+		// Header values must stay ASCII.
+		value := encodeCharset(string(data), unicode.MaxASCII)
+		if len(value) <= echoMaxBytes || len(names) == 0 {
+			w.Header().Set("X-Debug-Echo", string(value))
+			return
+		}
+		delete(echo.Headers, names[len(names)-1])
+		names = names[:len(names)-1]
+		echo.Truncated = true
+	}
+}
+
+// handleDebugRaw runs a chat request against the upstream and returns the
+// untranslated z.ai SSE stream byte for byte, for diagnosing translation
+// bugs and filing upstream format reports. Only available with DEBUG_MODE
+// and the admin key.
+func handleDebugRaw(w http.ResponseWriter, r *http.Request) {
+	if !DEBUG_MODE {
+		writeError(w, http.StatusNotFound, "debug endpoints require DEBUG_MODE", "invalid_request_error", "")
+		return
+	}
+	if !adminAuthorized(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "send a POST request with a JSON chat completion body", "invalid_request_error", "method_not_allowed")
+		return
+	}
+	var req OpenAIRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON", "invalid_request_error", "")
+		return
+	}
+	upstreamModel, ok := MODEL_MAP[req.Model]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "Unsupported model", "invalid_request_error", "model_not_found")
+		return
+	}
+	authToken, err := acquireAuthToken(req.Model)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, "upstream authentication unavailable", "upstream_error", "upstream_auth_unavailable")
+		return
+	}
+	resp, err := openUpstream(&req, upstreamModel, authToken)
+	if err != nil {
+		var statusErr *upstreamStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized {
+			anonTokens.invalidate(authToken)
+		}
+		writeUpstreamError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	setSSEHeaders(w)
+	w.Header().Set("X-Upstream-Content-Type", resp.Header.Get("Content-Type"))
+	w.Header().Set(upstreamChatIDHeader, resp.Header.Get(upstreamChatIDHeader))
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 4096)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := w.Write(buf[:n]); werr != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err != nil {
+			if err != io.EOF {
+				debugLog("Raw upstream stream failed: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// DebugModelConfig is the effective configuration of one model as reported
+// by /debug/config.
+type DebugModelConfig struct {
+	UpstreamModel string       `json:"upstream_model"`
+	OwnedBy       string       `json:"owned_by"`
+	Stream        bool         `json:"stream"`
+	RateLimit     int          `json:"rate_limit_per_minute,omitempty"`
+	Tokenizer     string       `json:"tokenizer"`
+	SystemPrompt  string       `json:"system_prompt,omitempty"`
+	Params        *ModelParams `json:"params,omitempty"`
+	ModelInfo
+}
+
+// handleDebugConfig reports the per-model configuration the proxy resolved
+// from its environment, without any secrets. Only available with DEBUG_MODE
+// and the admin key.
+func handleDebugConfig(w http.ResponseWriter, r *http.Request) {
+	if !DEBUG_MODE {
+		writeError(w, http.StatusNotFound, "debug endpoints require DEBUG_MODE", "invalid_request_error", "")
+		return
+	}
+	if !adminAuthorized(w, r) {
+		return
+	}
+	models := map[string]DebugModelConfig{}
+	for name, upstream := range MODEL_MAP {
+		stream, _ := resolveStream(&OpenAIRequest{Model: name})
+		config := DebugModelConfig{
+			UpstreamModel: upstream,
+			OwnedBy:       modelOwner(name),
+			Stream:        stream,
+			RateLimit:     MODEL_RATE_LIMITS[name],
+			Tokenizer:     modelTokenizerName(name),
+			SystemPrompt:  systemPrompt(name),
+			ModelInfo:     modelInfo(name),
+		}
+		if params, ok := MODEL_PARAMS[name]; ok {
+			config.Params = &params
+		}
+		models[name] = config
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"models": models})
+}
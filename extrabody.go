@@ -0,0 +1,45 @@
+package main
+
+import "encoding/json"
+
+// upstreamExtraBody combines UPSTREAM_EXTRA_BODY with the client's
+// extra_body, when allowed; client values win.
+func upstreamExtraBody(req *OpenAIRequest) map[string]interface{} {
+	if len(req.ExtraBody) > 0 && !ALLOW_CLIENT_EXTRA_BODY {
+		debugLog("Ignoring extra_body: ALLOW_CLIENT_EXTRA_BODY is not set")
+	}
+	if !ALLOW_CLIENT_EXTRA_BODY || len(req.ExtraBody) == 0 {
+		return UPSTREAM_EXTRA_BODY
+	}
+	extra := map[string]interface{}{}
+	deepMerge(extra, UPSTREAM_EXTRA_BODY)
+	deepMerge(extra, req.ExtraBody)
+	return extra
+}
+
+// mergeJSON deep-merges extra into the JSON object body.
+func mergeJSON(body []byte, extra map[string]interface{}) ([]byte, error) {
+	var merged map[string]interface{}
+	if err := json.Unmarshal(body, &merged); err != nil {
+		return nil, err
+	}
+	deepMerge(merged, extra)
+	return json.Marshal(merged)
+}
+
+// deepMerge copies src into dst, merging nested objects key by key and
+// replacing everything else.
+func deepMerge(dst, src map[string]interface{}) {
+	for key, value := range src {
+		if srcObj, ok := value.(map[string]interface{}); ok {
+			dstObj, ok := dst[key].(map[string]interface{})
+			if !ok {
+				dstObj = map[string]interface{}{}
+				dst[key] = dstObj
+			}
+			deepMerge(dstObj, srcObj)
+			continue
+		}
+		dst[key] = value
+	}
+}
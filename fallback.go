@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+)
+
+// openUpstreamWithFallback tries req.Model and then each model listed for it
+// in FALLBACK_MODELS, moving on only when the upstream failed in a way a
+// different model might not (5xx, 429 or a transport error). Each model is
+// only tried within its MODEL_RATE_LIMITS entry. It returns the response and
+// the client-facing name of the model that served it.
+func openUpstreamWithFallback(req *OpenAIRequest, authToken string) (*http.Response, string, error) {
+	chain := append([]string{req.Model}, FALLBACK_MODELS[req.Model]...)
+	var lastErr error
+	for i, model := range chain {
+		if msg := modelDenied(req, model); i > 0 && msg != "" {
+			debugLog("Skipping fallback model %s: %s", model, msg)
+			continue
+		}
+		if ok, wait := allowModel(model); !ok {
+			incCounter("z2api_model_throttled_total", "model", model)
+			debugLog("Skipping model %s: over its MODEL_RATE_LIMITS entry", model)
+			lastErr = &modelThrottledError{model: model, wait: wait}
+			continue
+		}
+		token := authToken
+		if UPSTREAM_TOKEN == "" && i > 0 && (ANON_BLOCKED_MODELS[model] || anonTokenScope(model) != anonTokenScope(req.Model)) {
+			// The fallback needs its own anonymous session, or may not use
+			// one at all.
+			var err error
+			if token, err = acquireAuthToken(model); err != nil {
+				lastErr = err
+				continue
+			}
+		}
+		resp, err := openUpstream(req, MODEL_MAP[model], token)
+		if err == nil {
+			if i > 0 {
+				log.Printf("Request for %s served by fallback model %s", req.Model, model)
+				incCounter("z2api_fallbacks_total", "model", req.Model, "served_by", model)
+			} else {
+				debugLog("Request served by %s", model)
+			}
+			return resp, model, nil
+		}
+		lastErr = err
+		if !retryableUpstreamError(err) || req.deadlineExceeded() {
+			break
+		}
+		if i+1 < len(chain) {
+			log.Printf("Model %s failed (%v), falling back to %s", model, err, chain[i+1])
+		}
+	}
+	return nil, "", lastErr
+}
+
+// retryableUpstreamError reports whether err is worth retrying elsewhere.
+// Other 4xx replies mean the request itself was rejected.
+func retryableUpstreamError(err error) bool {
+	var statusErr *upstreamStatusError
+	if !errors.As(err, &statusErr) {
+		return true
+	}
+	return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// feVersionPattern matches the frontend build id embedded in the chat.z.ai
+// page, e.g. prod-fe-1.0.70.
+var feVersionPattern = regexp.MustCompile(`prod-fe-[0-9]+(?:\.[0-9]+)+`)
+
+// feVersionRefreshInterval bounds how often a rejection may trigger a scrape,
+// so a burst of rejected requests fetches the page once.
+const feVersionRefreshInterval = time.Minute
+
+// feVersionState holds the X-FE-Version in use. It starts as X_FE_VERSION
+// and is replaced when the upstream reports a new version.
+type feVersionState struct {
+	mu          sync.Mutex
+	value       string
+	lastAttempt time.Time
+	fetching    chan struct{} // closed when the running scrape finishes
+}
+
+var feVersion feVersionState
+
+func (v *feVersionState) current() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.value == "" {
+		return X_FE_VERSION
+	}
+	return v.value
+}
+
+// refresh replaces the version after stale was rejected and returns the one
+// to retry with. If another request already moved past stale, that version is
+// returned without fetching; if one is fetching it right now, refresh waits
+// for it. The page is fetched without holding mu, which current() takes on
+// every request.
+func (v *feVersionState) refresh(stale string) (string, error) {
+	v.mu.Lock()
+	if fetching := v.fetching; fetching != nil {
+		v.mu.Unlock()
+		<-fetching
+		v.mu.Lock()
+	}
+	if v.value != "" && v.value != stale {
+		defer v.mu.Unlock()
+		return v.value, nil
+	}
+	if time.Since(v.lastAttempt) < feVersionRefreshInterval {
+		v.mu.Unlock()
+		return "", errors.New("refreshed recently")
+	}
+	v.lastAttempt = time.Now()
+	fetching := make(chan struct{})
+	v.fetching = fetching
+	v.mu.Unlock()
+
+	version, err := scrapeFEVersion()
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.fetching = nil
+	close(fetching)
+	if err != nil {
+		return "", err
+	}
+	if version == stale {
+		return "", fmt.Errorf("%s still advertises %s", FE_VERSION_URL, version)
+	}
+	v.value = version
+	return version, nil
+}
+
+// scrapeFEVersion reads the current frontend version from the chat.z.ai page.
+func scrapeFEVersion() (string, error) {
+	client := &http.Client{Timeout: 10 * time.Second, Transport: upstreamTransport}
+	req, err := http.NewRequest("GET", FE_VERSION_URL, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", BROWSER_UA)
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("frontend page status=%d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return "", err
+	}
+	version := feVersionPattern.Find(body)
+	if version == nil {
+		return "", fmt.Errorf("no frontend version found at %s", FE_VERSION_URL)
+	}
+	return string(version), nil
+}
+
+// isNewVersionError reports whether the upstream rejected the request for an
+// outdated X-FE-Version.
+func isNewVersionError(err *upstreamStatusError) bool {
+	return strings.Contains(strings.ToLower(err.Body), "new version found")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotentEntry is the recorded outcome of one Idempotency-Key.
+type idempotentEntry struct {
+	bodyHash [32]byte
+	done     chan struct{}
+	status   int
+	header   http.Header
+	body     []byte
+	ok       bool // false if the response was not cacheable
+	expires  time.Time
+}
+
+var (
+	idempotencyMu    sync.Mutex
+	idempotencyCache = map[string]*idempotentEntry{}
+	idempotencyOrder []string // insertion order, for evicting the oldest
+)
+
+// serveIdempotent runs serve at most once per (caller, Idempotency-Key)
+// within IDEMPOTENCY_TTL. A duplicate waits for the in-flight original if
+// needed and then receives the same response, marked Idempotent-Replayed.
+func serveIdempotent(w http.ResponseWriter, r *http.Request, apiKey, key string, serve func(http.ResponseWriter, *http.Request, string)) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Failed to read request body", "invalid_request_error", "")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	hash := sha256.Sum256(body)
+	cacheKey := requestCacheIdentity(r, apiKey) + "\x00" + key
+
+	idempotencyMu.Lock()
+	entry, found := idempotencyCache[cacheKey]
+	if found && entry.expires.Before(time.Now()) {
+		delete(idempotencyCache, cacheKey)
+		found = false
+	}
+	if !found {
+		entry = &idempotentEntry{bodyHash: hash, done: make(chan struct{}), expires: time.Now().Add(IDEMPOTENCY_TTL)}
+		storeIdempotentEntry(cacheKey, entry)
+	}
+	idempotencyMu.Unlock()
+
+	if found {
+		if entry.bodyHash != hash {
+			writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used with a different request body", "invalid_request_error", "idempotency_key_reused")
+			return
+		}
+		select {
+		case <-entry.done:
+		case <-r.Context().Done():
+			return
+		}
+		if entry.ok {
+			debugLog("Replaying response for Idempotency-Key %q", key)
+			for name, values := range entry.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(entry.status)
+			w.Write(entry.body)
+			return
+		}
+		// The original was not cacheable; run this one for real.
+	}
+
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	serve(rec, r, apiKey)
+
+	idempotencyMu.Lock()
+	if !found {
+		// Errors that a retry might fix, and oversized bodies, are not kept.
+		entry.ok = rec.status < 500 && !rec.overflow
+		entry.status, entry.header, entry.body = rec.status, w.Header().Clone(), rec.buf.Bytes()
+		if !entry.ok {
+			entry.body = nil
+			delete(idempotencyCache, cacheKey)
+		}
+		close(entry.done)
+	}
+	idempotencyMu.Unlock()
+}
+
+// storeIdempotentEntry inserts entry, evicting the oldest entries beyond
+// IDEMPOTENCY_MAX_ENTRIES. Callers hold idempotencyMu.
+func storeIdempotentEntry(cacheKey string, entry *idempotentEntry) {
+	idempotencyCache[cacheKey] = entry
+	idempotencyOrder = append(idempotencyOrder, cacheKey)
+	for len(idempotencyCache) > IDEMPOTENCY_MAX_ENTRIES && len(idempotencyOrder) > 0 {
+		oldest := idempotencyOrder[0]
+		idempotencyOrder = idempotencyOrder[1:]
+		if old, ok := idempotencyCache[oldest]; ok && old != entry {
+			delete(idempotencyCache, oldest)
+		}
+	}
+	if len(idempotencyOrder) > 2*IDEMPOTENCY_MAX_ENTRIES {
+		// Drop keys that were already deleted so the slice stays bounded.
+		live := idempotencyOrder[:0]
+		for _, k := range idempotencyOrder {
+			if _, ok := idempotencyCache[k]; ok {
+				live = append(live, k)
+			}
+		}
+		idempotencyOrder = live
+	}
+}
+
+// responseRecorder passes a response through while keeping a copy of it,
+// up to IDEMPOTENCY_MAX_BYTES.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	buf         bytes.Buffer
+	overflow    bool
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	if !rec.overflow {
+		if rec.buf.Len()+len(b) > IDEMPOTENCY_MAX_BYTES {
+			rec.overflow = true
+			rec.buf = bytes.Buffer{}
+		} else {
+			rec.buf.Write(b)
+		}
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
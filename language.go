@@ -0,0 +1,120 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"unicode"
+)
+
+// languageScripts identify languages by writing system, checked in order:
+// Japanese text also contains Han characters, so kana is looked for first.
+var languageScripts = []struct {
+	code   string
+	tables []*unicode.RangeTable
+}{
+	{"ja", []*unicode.RangeTable{unicode.Hiragana, unicode.Katakana}},
+	{"ko", []*unicode.RangeTable{unicode.Hangul}},
+	{"zh", []*unicode.RangeTable{unicode.Han}},
+	{"ru", []*unicode.RangeTable{unicode.Cyrillic}},
+	{"ar", []*unicode.RangeTable{unicode.Arabic}},
+	{"he", []*unicode.RangeTable{unicode.Hebrew}},
+	{"el", []*unicode.RangeTable{unicode.Greek}},
+	{"th", []*unicode.RangeTable{unicode.Thai}},
+	{"hi", []*unicode.RangeTable{unicode.Devanagari}},
+}
+
+// latinStopwords tell apart a few common Latin-script languages; text that
+// matches none of them is taken as English.
+var latinStopwords = map[string][]string{
+	"es": {"el", "la", "los", "las", "que", "de", "y", "es", "por", "para", "con", "una", "cómo", "qué"},
+	"fr": {"le", "la", "les", "des", "est", "et", "une", "que", "pour", "dans", "avec", "qui", "pas", "vous"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "ich", "mit", "zu", "wie", "was", "sie"},
+	"pt": {"o", "os", "as", "que", "de", "e", "não", "uma", "para", "com", "como", "você", "é", "do"},
+	"it": {"il", "lo", "gli", "che", "di", "e", "non", "una", "per", "con", "come", "sono", "è", "della"},
+	"en": {"the", "is", "and", "of", "to", "a", "in", "what", "how", "you", "it", "that", "for", "with"},
+}
+
+// detectLanguage guesses the language of s as a two-letter code, from the
+// dominant script and, for Latin text, stopword counts. It returns "" for
+// text with no letters.
+func detectLanguage(s string) string {
+	counts := map[string]int{}
+	latin, letters := 0, 0
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for _, script := range languageScripts {
+			if unicode.In(r, script.tables...) {
+				counts[script.code]++
+				break
+			}
+		}
+	}
+	if letters == 0 {
+		return ""
+	}
+	if counts["ja"] > 0 {
+		return "ja"
+	}
+	best, bestCount := "", 0
+	for _, script := range languageScripts {
+		if counts[script.code] > bestCount {
+			best, bestCount = script.code, counts[script.code]
+		}
+	}
+	// A CJK character carries about as much as a short Latin word, so
+	// scripts are compared with some weight against Latin letters.
+	if bestCount > 0 && bestCount*3 >= latin {
+		return best
+	}
+	return detectLatinLanguage(s)
+}
+
+func detectLatinLanguage(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool { return !unicode.IsLetter(r) })
+	best, bestCount := "en", 0
+	for _, code := range []string{"en", "es", "fr", "de", "pt", "it"} {
+		count := 0
+		for _, word := range words {
+			if contains(latinStopwords[code], word) {
+				count++
+			}
+		}
+		if count > bestCount {
+			best, bestCount = code, count
+		}
+	}
+	return best
+}
+
+// applyLanguageRouting switches req to the LANGUAGE_ROUTING model for the
+// language of its last user message, unless the caller may not use that
+// model. It runs before the model is authorized, which modelDenied then
+// checks again on whatever model routing settled on.
+func applyLanguageRouting(req *OpenAIRequest) {
+	var prompt string
+	for i := len(req.Messages) - 1; i >= 0; i-- {
+		if req.Messages[i].Role == "user" {
+			prompt = req.Messages[i].Content
+			break
+		}
+	}
+	lang := detectLanguage(prompt)
+	model, ok := LANGUAGE_ROUTING[lang]
+	if !ok || model == req.Model {
+		debugLog("Detected language %q for %s request, not routing", lang, req.Model)
+		return
+	}
+	if msg := modelDenied(req, model); msg != "" {
+		log.Printf("Detected language %q, not routing %s request to %s: %s", lang, req.Model, model, msg)
+		return
+	}
+	log.Printf("Detected language %q, routing %s request to %s", lang, req.Model, model)
+	req.Model = model
+}
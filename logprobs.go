@@ -0,0 +1,70 @@
+package main
+
+// Logprobs is the OpenAI choices[].logprobs object.
+type Logprobs struct {
+	Content []TokenLogprob `json:"content"`
+}
+
+type TokenLogprob struct {
+	Token       string       `json:"token"`
+	Logprob     float64      `json:"logprob"`
+	Bytes       []int        `json:"bytes"`
+	TopLogprobs []TopLogprob `json:"top_logprobs"`
+}
+
+type TopLogprob struct {
+	Token   string  `json:"token"`
+	Logprob float64 `json:"logprob"`
+	Bytes   []int   `json:"bytes"`
+}
+
+// maxTopLogprobs is the OpenAI limit for top_logprobs.
+const maxTopLogprobs = 20
+
+// validateLogprobs checks logprobs/top_logprobs and, with
+// LOGPROBS_UNSUPPORTED=error, rejects models not known to return them.
+func validateLogprobs(req *OpenAIRequest) (string, string) {
+	if req.TopLogprobs != nil {
+		if *req.TopLogprobs < 0 || *req.TopLogprobs > maxTopLogprobs {
+			return "top_logprobs", "top_logprobs must be between 0 and 20"
+		}
+		if !req.Logprobs {
+			return "top_logprobs", "top_logprobs requires logprobs to be true"
+		}
+	}
+	if req.Logprobs && LOGPROBS_UNSUPPORTED == "error" && !modelInfo(req.Model).hasCapability("logprobs") {
+		return "logprobs", "Model " + req.Model + " does not return logprobs"
+	}
+	return "", ""
+}
+
+// trimTopLogprobs keeps at most n alternatives per token and fills in the
+// bytes the upstream left out.
+func trimTopLogprobs(entries []TokenLogprob, n int) []TokenLogprob {
+	for i := range entries {
+		e := &entries[i]
+		if len(e.TopLogprobs) > n {
+			e.TopLogprobs = e.TopLogprobs[:n]
+		}
+		if e.TopLogprobs == nil {
+			e.TopLogprobs = []TopLogprob{}
+		}
+		if e.Bytes == nil {
+			e.Bytes = tokenBytes(e.Token)
+		}
+		for j := range e.TopLogprobs {
+			if e.TopLogprobs[j].Bytes == nil {
+				e.TopLogprobs[j].Bytes = tokenBytes(e.TopLogprobs[j].Token)
+			}
+		}
+	}
+	return entries
+}
+
+func tokenBytes(token string) []int {
+	b := make([]int, len(token))
+	for i := 0; i < len(token); i++ {
+		b[i] = int(token[i])
+	}
+	return b
+}
@@ -2,37 +2,346 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/netip"
+	"net/url"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 )
 
 // Config variables from environment
 var (
 	UPSTREAM_URL   string
 	DEFAULT_KEY    string
+	API_KEYS       map[string]bool
 	UPSTREAM_TOKEN string
 	MODEL_MAP      map[string]string
+	MODEL_OWNED_BY map[string]string
+	MODEL_STREAM   map[string]bool
 	PORT           string
 	DEBUG_MODE     bool
 	DEFAULT_STREAM bool
+
+	// MODEL_RATE_LIMITS caps requests per minute for individual models.
+	MODEL_RATE_LIMITS map[string]int
+
+	// MODEL_TOKENIZER picks the token estimator (see tokenizers) per model.
+	MODEL_TOKENIZER map[string]string
+
+	// UPSTREAM_TOKEN may list several comma-separated tokens to rotate
+	// over; see tokenPool for the quarantine of failing ones.
+	TOKEN_QUARANTINE_THRESHOLD int
+	TOKEN_QUARANTINE_COOLDOWN  time.Duration
+
+	ANON_TOKEN_URL     string
+	ANON_TOKEN_FIELD   string
+	ANON_TOKEN_TTL     time.Duration
+	ANON_TOKEN_WARMUP  bool
+	ANON_TOKEN_RETRIES int
+
+	// ANON_TOKEN_PER_MODEL gives each upstream model its own anonymous
+	// token instead of sharing one.
+	ANON_TOKEN_PER_MODEL bool
+
+	ANON_FETCH_MIN_INTERVAL time.Duration
+
+	// X_FE_VERSION is the frontend version sent as X-FE-Version; it is
+	// replaced at runtime when the upstream reports a newer one.
+	X_FE_VERSION   string
+	FE_VERSION_URL string
+
+	// UPSTREAM_REQUEST_ID_HEADER names the header carrying our request id to
+	// the upstream; "off" leaves it out.
+	UPSTREAM_REQUEST_ID_HEADER string
+
+	// UPSTREAM_PING_INTERVAL enables a background probe of UPSTREAM_PING_URL
+	// whose result /health reports.
+	UPSTREAM_PING_INTERVAL time.Duration
+	UPSTREAM_PING_URL      string
+
+	// AUTH_MODE is how clients authenticate: bearer (a key from API_KEYS),
+	// hmac (requests signed with a secret from HMAC_KEYS) or jwt (tokens
+	// signed by JWT_PUBLIC_KEY, with model scopes). See auth.go.
+	AUTH_MODE       string
+	HMAC_KEYS       map[string]string
+	HMAC_MAX_SKEW   time.Duration
+	JWT_ISSUER      string
+	JWT_AUDIENCE    string
+	JWT_SCOPE_CLAIM string
+	jwtPublicKey    crypto.PublicKey
+
+	// FORWARD_CLIENT_IP names the header that carries the client's address
+	// to the upstream, empty to not send it. X-Forwarded-For from peers in
+	// TRUSTED_PROXIES is honoured when resolving that address.
+	FORWARD_CLIENT_IP string
+	TRUSTED_PROXIES   []netip.Prefix
+
+	// SYSTEM_PROMPT is injected into every request, or the model's
+	// MODEL_SYSTEM_PROMPTS entry where one exists; SYSTEM_PROMPT_MODE
+	// (prepend, replace or skip) decides how it meets the client's own
+	// system messages.
+	SYSTEM_PROMPT        string
+	SYSTEM_PROMPT_MODE   string
+	MODEL_SYSTEM_PROMPTS map[string]string
+
+	// STREAM_IDLE_TIMEOUT ends a stream whose upstream sends nothing for
+	// that long, and MAX_STREAM_DURATION one that runs longer than that in
+	// total; 0 disables either.
+	STREAM_IDLE_TIMEOUT time.Duration
+	MAX_STREAM_DURATION time.Duration
+
+	// REQUEST_DEADLINE bounds a whole chat request, queueing, retries and
+	// fallbacks included; 0 disables it.
+	REQUEST_DEADLINE time.Duration
+
+	// STRICT_REQUEST_VALIDATION rejects unknown top-level request fields
+	// and empty messages; see decodeChatRequest.
+	STRICT_REQUEST_VALIDATION bool
+
+	// UPSTREAM_FEATURES is the base z.ai features map of every request; see
+	// upstreamFeatures.
+	UPSTREAM_FEATURES map[string]interface{}
+
+	// OMIT_RESPONSE_FIELDS are optional fields left out of every response
+	// and chunk, on top of a request's X-Omit-Fields.
+	OMIT_RESPONSE_FIELDS []string
+
+	// ROOT_PAGE is the format of the status page on GET /: auto, json, html
+	// or off.
+	ROOT_PAGE string
+
+	// ENABLE_UI serves a test chat page on GET /ui.
+	ENABLE_UI bool
+
+	// Connection pool limits of upstreamTransport; 0 means unlimited, as in
+	// http.Transport.
+	MAX_IDLE_CONNS          int
+	MAX_IDLE_CONNS_PER_HOST int
+	MAX_CONNS_PER_HOST      int
+	IDLE_CONN_TIMEOUT       time.Duration
+
+	// GZIP_ENABLED compresses non-stream responses of at least
+	// GZIP_MIN_BYTES for clients that accept gzip.
+	GZIP_ENABLED   bool
+	GZIP_MIN_BYTES int
+
+	// UPSTREAM_GZIP compresses upstream request bodies of at least
+	// UPSTREAM_GZIP_MIN_BYTES, for upstreams that accept them.
+	UPSTREAM_GZIP           bool
+	UPSTREAM_GZIP_MIN_BYTES int
+
+	// STATUS_CODE_MAP replaces upstream error statuses with the ones
+	// clients see, e.g. 429 as 503; unlisted codes pass through.
+	STATUS_CODE_MAP map[int]int
+
+	// RESPONSE_CHARSET labels, and if not UTF-8 transcodes, JSON and event
+	// stream responses for legacy clients. Empty leaves responses as is.
+	RESPONSE_CHARSET string
+
+	// UPSTREAM_EXTRA_BODY is deep-merged into every upstream request body;
+	// ALLOW_CLIENT_EXTRA_BODY also merges the request's extra_body.
+	UPSTREAM_EXTRA_BODY     map[string]interface{}
+	ALLOW_CLIENT_EXTRA_BODY bool
+
+	// DAILY_BUDGET caps what each API key may spend per UTC day, priced with
+	// MODEL_PRICES; KEY_BUDGETS overrides it per key.
+	DAILY_BUDGET float64
+	KEY_BUDGETS  map[string]float64
+	MODEL_PRICES map[string]ModelPrice
+	BUDGET_FILE  string
+
+	// KEY_MODEL_ACL lists the models each API key may use. Keys it does not
+	// mention may use all models, or none with KEY_MODEL_ACL_STRICT.
+	KEY_MODEL_ACL        map[string][]string
+	KEY_MODEL_ACL_STRICT bool
+
+	// AUDIT_LOG is a file receiving one JSON record per chat request.
+	AUDIT_LOG string
+
+	// CONVERSATION_STORE keeps the X-Conversation-ID to upstream chat_id
+	// mapping in "memory" or in a "file:<path>" that survives restarts.
+	CONVERSATION_STORE string
+	CONVERSATION_TTL   time.Duration
+
+	// ANON_BLOCKED_MODELS must be served with UPSTREAM_TOKEN, never with an
+	// anonymous token.
+	ANON_BLOCKED_MODELS map[string]bool
+
+	// RETURN_PARTIAL_ON_TIMEOUT is the finish_reason given to non-stream
+	// content salvaged from an upstream timeout; empty returns the error.
+	RETURN_PARTIAL_ON_TIMEOUT string
+
+	STRIP_CODE_FENCES bool
+	DEDUPE_DELTAS     bool
+
+	// THINK_TAGS_MODE controls reasoning output: "strip" drops it, "think"
+	// wraps it in <think></think>, "raw" passes the upstream markup through.
+	THINK_TAGS_MODE string
+
+	DRAIN_DELAY      time.Duration
+	SHUTDOWN_TIMEOUT time.Duration
+
+	// SLOW_REQUEST_THRESHOLD logs a timing breakdown of every request that
+	// takes longer; 0 disables the log.
+	SLOW_REQUEST_THRESHOLD time.Duration
+
+	MAX_CONCURRENCY int
+
+	// KEY_PRIORITIES assigns API keys a QoS class (high, normal or low) for
+	// the MAX_CONCURRENCY queue. It is also the highest class the key may
+	// ask for with the X-Priority header.
+	KEY_PRIORITIES map[string]string
+
+	MAX_BEST_OF      int
+	BEST_OF_STRATEGY string
+
+	// MAX_MESSAGES bounds the messages per request; MAX_MESSAGES_MODE is
+	// "reject" or "trim" (keep system messages and the most recent rest).
+	MAX_MESSAGES      int
+	MAX_MESSAGES_MODE string
+
+	// MAX_IMAGES_PER_REQUEST bounds the image parts across all messages;
+	// 0 disables the limit.
+	MAX_IMAGES_PER_REQUEST int
+
+	SSE_RESUME        bool
+	SSE_RESUME_BUFFER int
+	SSE_RESUME_TTL    time.Duration
+	SSE_RETRY         time.Duration
+	SSE_EXTRA_NEWLINE bool
+
+	LEGACY_FUNCTION_CALL bool
+
+	// TOOL_CALL_DETECTION turns tool calls the upstream wrote into the
+	// answer as fenced JSON into structured tool_calls; see scanToolCalls.
+	TOOL_CALL_DETECTION bool
+
+	CHUNK_SIZE int
+
+	TEMPERATURE_RANGE [2]float64
+	TOP_P_RANGE       [2]float64
+
+	// TEMPERATURE_ZERO_EPSILON replaces a requested temperature of 0: a
+	// number is sent instead, "omit" leaves temperature out. Empty sends 0.
+	TEMPERATURE_ZERO_EPSILON string
+
+	RESPONSE_HEADERS map[string]string
+
+	PROGRESS_INTERVAL time.Duration
+
+	FALLBACK_MODELS map[string][]string
+
+	// LANGUAGE_ROUTING maps detected prompt languages (two-letter codes) to
+	// the model that serves them, overriding the requested one.
+	LANGUAGE_ROUTING map[string]string
+
+	IDEMPOTENCY_TTL         time.Duration
+	IDEMPOTENCY_MAX_ENTRIES int
+	IDEMPOTENCY_MAX_BYTES   int
+
+	// COALESCE_ENABLED lets identical concurrent chat requests share one
+	// upstream call; see serveCoalesced.
+	COALESCE_ENABLED bool
+
+	MODEL_METADATA map[string]ModelInfo
+	MODEL_PARAMS   map[string]ModelParams
+
+	LOG_CONTENT_MAX int
+
+	ADMIN_KEY string
+
+	EVENT_REASSEMBLY_MAX_BYTES int
+
+	MAX_BATCH_SIZE int
+
+	// LOGPROBS_UNSUPPORTED is what to do when logprobs are requested from a
+	// model without the "logprobs" capability: "null" forwards the request and
+	// returns whatever the upstream sends, "error" rejects it.
+	LOGPROBS_UNSUPPORTED string
+
+	// IMAGE_ON_TEXT_MODEL decides what happens to images sent to a model
+	// without vision: "reject", "strip" or "route" to a vision model.
+	IMAGE_ON_TEXT_MODEL string
+
+	// STREAM_UNSUPPORTED_MODE decides what a stream request to a model
+	// with "streaming": false gets: "error" rejects it, "buffer" generates
+	// the whole completion and only then sends it as a stream.
+	STREAM_UNSUPPORTED_MODE string
+
+	CONTEXT_LENGTH_CHECK bool
+
+	MAX_OUTPUT_TOKENS_CAP int
+
+	// MAX_THINKING_TOKENS cuts the reasoning shown in think mode after this
+	// many (estimated) tokens; the answer itself is not affected.
+	MAX_THINKING_TOKENS int
+
+	// TRIM_TRAILING drops whitespace at the end of the content, and the
+	// whitespace-only final chunks that carry it.
+	TRIM_TRAILING bool
+
+	UPSTREAM_CHAT_ID_FIELD bool
+
+	// UPSTREAM_MODEL_HEADER reports the upstream model id that served each
+	// request in X-Upstream-Model.
+	UPSTREAM_MODEL_HEADER bool
+
+	SYSTEM_FINGERPRINT string
+
+	PLUGIN_CMD     string
+	PLUGIN_TIMEOUT time.Duration
+
+	// MODERATION_URL, if set, is asked to allow or deny every prompt before
+	// it is sent upstream; MODERATION_FAIL_MODE ("open" or "closed") decides
+	// what happens when it cannot answer within MODERATION_TIMEOUT.
+	MODERATION_URL       string
+	MODERATION_TIMEOUT   time.Duration
+	MODERATION_FAIL_MODE string
+
+	// OUTPUT_TRIM_LEADING is removed from the very start of each answer,
+	// e.g. `\s+` for a stray leading newline. Compiled from the env var.
+	OUTPUT_TRIM_LEADING *regexp.Regexp
+
+	// REDACT_PATTERNS are replaced by REDACT_PLACEHOLDER in message content
+	// before it is sent upstream.
+	REDACT_PATTERNS    []*regexp.Regexp
+	REDACT_PLACEHOLDER string
 )
 
+// configErrors collects settings that failed to parse in initConfig;
+// validateConfig refuses to start with any of them.
+var configErrors []error
+
 // Constants
 const (
-	X_FE_VERSION     = "prod-fe-1.0.70"
+	DEFAULT_FE_VERSION = "prod-fe-1.0.70"
 	BROWSER_UA       = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/139.0.0.0 Safari/537.36 Edg/139.0.0.0"
 	SEC_CH_UA        = "\"Not;A=Brand\";v=\"99\", \"Microsoft Edge\";v=\"139\", \"Chromium\";v=\"139\""
 	SEC_CH_UA_MOB    = "?0"
 	SEC_CH_UA_PLAT   = "\"Windows\""
 	ORIGIN_BASE      = "https://chat.z.ai"
 	ANON_TOKEN_ENABLED = true
-	THINK_TAGS_MODE    = "strip"
 )
 
 // Init config from environment variables
@@ -40,19 +349,162 @@ func initConfig() {
 	UPSTREAM_URL = getEnv("UPSTREAM_URL", "https://chat.z.ai/api/chat/completions")
 	DEFAULT_KEY = getEnv("DEFAULT_KEY", "sk-your-key")
 	UPSTREAM_TOKEN = getEnv("UPSTREAM_TOKEN", "") // Must be set by user
+	upstreamTokens = newTokenPool(UPSTREAM_TOKEN)
+	TOKEN_QUARANTINE_THRESHOLD = getEnvInt("TOKEN_QUARANTINE_THRESHOLD", 3)
+	TOKEN_QUARANTINE_COOLDOWN = getEnvDuration("TOKEN_QUARANTINE_COOLDOWN", time.Minute)
+	ANON_TOKEN_URL = getEnv("ANON_TOKEN_URL", ORIGIN_BASE+"/api/v1/auths/")
+	ANON_TOKEN_FIELD = getEnv("ANON_TOKEN_FIELD", "token")
+	ANON_TOKEN_TTL = getEnvDuration("ANON_TOKEN_TTL", 5*time.Minute)
+	ANON_TOKEN_WARMUP = getEnv("ANON_TOKEN_WARMUP", "true") == "true"
+	ANON_TOKEN_RETRIES = getEnvInt("ANON_TOKEN_RETRIES", 2)
+	ANON_TOKEN_PER_MODEL = getEnv("ANON_TOKEN_PER_MODEL", "false") == "true"
+	ANON_FETCH_MIN_INTERVAL = getEnvDuration("ANON_FETCH_MIN_INTERVAL", time.Second)
+	X_FE_VERSION = getEnv("X_FE_VERSION", DEFAULT_FE_VERSION)
+	FE_VERSION_URL = getEnv("FE_VERSION_URL", ORIGIN_BASE+"/")
+	UPSTREAM_REQUEST_ID_HEADER = getEnv("UPSTREAM_REQUEST_ID_HEADER", "X-Request-ID")
+	UPSTREAM_PING_INTERVAL = getEnvDuration("UPSTREAM_PING_INTERVAL", 0)
+	UPSTREAM_PING_URL = getEnv("UPSTREAM_PING_URL", ANON_TOKEN_URL)
+	AUTH_MODE = getEnv("AUTH_MODE", "bearer")
+	HMAC_KEYS = parsePairs("HMAC_KEYS", getEnv("HMAC_KEYS", ""))
+	HMAC_MAX_SKEW = getEnvDuration("HMAC_MAX_SKEW", 5*time.Minute)
+	JWT_ISSUER = getEnv("JWT_ISSUER", "")
+	JWT_AUDIENCE = getEnv("JWT_AUDIENCE", "")
+	JWT_SCOPE_CLAIM = getEnv("JWT_SCOPE_CLAIM", "scope")
+	switch AUTH_MODE {
+	case "bearer":
+	case "hmac":
+		if len(HMAC_KEYS) == 0 {
+			configErrors = append(configErrors, errors.New("AUTH_MODE=hmac needs HMAC_KEYS"))
+		}
+	case "jwt":
+		key, err := loadJWTPublicKey(getEnv("JWT_PUBLIC_KEY", ""))
+		if err != nil {
+			configErrors = append(configErrors, fmt.Errorf("AUTH_MODE=jwt needs a valid JWT_PUBLIC_KEY: %v", err))
+		}
+		jwtPublicKey = key
+	default:
+		configErrors = append(configErrors, fmt.Errorf("AUTH_MODE must be bearer, hmac or jwt, got %q", AUTH_MODE))
+	}
+	switch FORWARD_CLIENT_IP = getEnv("FORWARD_CLIENT_IP", ""); FORWARD_CLIENT_IP {
+	case "true":
+		FORWARD_CLIENT_IP = "X-Forwarded-For"
+	case "false":
+		FORWARD_CLIENT_IP = ""
+	}
+	if proxies, err := parseTrustedProxies(getEnv("TRUSTED_PROXIES", "127.0.0.0/8,::1,10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,fc00::/7")); err != nil {
+		configErrors = append(configErrors, fmt.Errorf("TRUSTED_PROXIES: %v", err))
+	} else {
+		TRUSTED_PROXIES = proxies
+	}
+	SYSTEM_PROMPT = getEnv("SYSTEM_PROMPT", "")
+	SYSTEM_PROMPT_MODE = getEnv("SYSTEM_PROMPT_MODE", "prepend")
+	if !contains([]string{"prepend", "replace", "skip"}, SYSTEM_PROMPT_MODE) {
+		configErrors = append(configErrors, fmt.Errorf("SYSTEM_PROMPT_MODE must be prepend, replace or skip, got %q", SYSTEM_PROMPT_MODE))
+	}
+	getEnvJSON("MODEL_SYSTEM_PROMPTS", &MODEL_SYSTEM_PROMPTS)
+	STREAM_IDLE_TIMEOUT = getEnvDuration("STREAM_IDLE_TIMEOUT", 0)
+	MAX_STREAM_DURATION = getEnvDuration("MAX_STREAM_DURATION", 0)
+	REQUEST_DEADLINE = getEnvDuration("REQUEST_DEADLINE", 0)
+	STRICT_REQUEST_VALIDATION = getEnv("STRICT_REQUEST_VALIDATION", "false") == "true"
+	UPSTREAM_FEATURES = map[string]interface{}{"enable_thinking": true}
+	if os.Getenv("UPSTREAM_FEATURES") != "" {
+		UPSTREAM_FEATURES = nil
+		getEnvJSON("UPSTREAM_FEATURES", &UPSTREAM_FEATURES)
+	}
+	if fields, err := parseOmitFields(getEnv("OMIT_RESPONSE_FIELDS", "")); err != nil {
+		configErrors = append(configErrors, fmt.Errorf("OMIT_RESPONSE_FIELDS: %v", err))
+	} else {
+		OMIT_RESPONSE_FIELDS = fields
+	}
+	ROOT_PAGE = getEnv("ROOT_PAGE", "auto")
+	if !contains([]string{"auto", "json", "html", "off"}, ROOT_PAGE) {
+		configErrors = append(configErrors, fmt.Errorf("ROOT_PAGE must be auto, json, html or off, got %q", ROOT_PAGE))
+	}
+	ENABLE_UI = getEnv("ENABLE_UI", "false") == "true"
+	MAX_IDLE_CONNS = getEnvInt("MAX_IDLE_CONNS", 100)
+	MAX_IDLE_CONNS_PER_HOST = getEnvInt("MAX_IDLE_CONNS_PER_HOST", http.DefaultMaxIdleConnsPerHost)
+	MAX_CONNS_PER_HOST = getEnvInt("MAX_CONNS_PER_HOST", 0)
+	IDLE_CONN_TIMEOUT = getEnvDuration("IDLE_CONN_TIMEOUT", 90*time.Second)
+	for name, value := range map[string]int{"MAX_IDLE_CONNS": MAX_IDLE_CONNS, "MAX_IDLE_CONNS_PER_HOST": MAX_IDLE_CONNS_PER_HOST, "MAX_CONNS_PER_HOST": MAX_CONNS_PER_HOST} {
+		if value < 0 {
+			configErrors = append(configErrors, fmt.Errorf("%s must not be negative, got %d", name, value))
+		}
+	}
+	upstreamTransport = newUpstreamTransport()
+	GZIP_ENABLED = getEnv("GZIP_ENABLED", "false") == "true"
+	GZIP_MIN_BYTES = getEnvInt("GZIP_MIN_BYTES", 1024)
+	UPSTREAM_GZIP = getEnv("UPSTREAM_GZIP", "false") == "true"
+	UPSTREAM_GZIP_MIN_BYTES = getEnvInt("UPSTREAM_GZIP_MIN_BYTES", 8192)
+	STATUS_CODE_MAP = make(map[int]int)
+	for from, to := range parsePairs("STATUS_CODE_MAP", getEnv("STATUS_CODE_MAP", "")) {
+		fromCode, err1 := strconv.Atoi(from)
+		toCode, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || fromCode < 400 || fromCode > 599 || toCode < 400 || toCode > 599 {
+			configErrors = append(configErrors, fmt.Errorf("STATUS_CODE_MAP entry %s:%s must map one HTTP error status (400-599) to another", from, to))
+			continue
+		}
+		STATUS_CODE_MAP[fromCode] = toCode
+	}
+
+	if charset := getEnv("RESPONSE_CHARSET", ""); charset != "" {
+		if RESPONSE_CHARSET = normalizeCharset(charset); RESPONSE_CHARSET == "" {
+			configErrors = append(configErrors, fmt.Errorf("RESPONSE_CHARSET must be utf-8, iso-8859-1 or us-ascii, got %q", charset))
+		}
+	}
+	getEnvJSON("UPSTREAM_EXTRA_BODY", &UPSTREAM_EXTRA_BODY)
+	ALLOW_CLIENT_EXTRA_BODY = getEnv("ALLOW_CLIENT_EXTRA_BODY", "false") == "true"
+	if value := getEnv("DAILY_BUDGET", ""); value != "" {
+		budget, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			configErrors = append(configErrors, fmt.Errorf("DAILY_BUDGET is not a number: %q", value))
+		}
+		DAILY_BUDGET = budget
+	}
+	getEnvJSON("KEY_BUDGETS", &KEY_BUDGETS)
+	getEnvJSON("MODEL_PRICES", &MODEL_PRICES)
+	BUDGET_FILE = getEnv("BUDGET_FILE", "")
+	getEnvJSON("KEY_MODEL_ACL", &KEY_MODEL_ACL)
+	KEY_MODEL_ACL_STRICT = getEnv("KEY_MODEL_ACL_STRICT", "false") == "true"
+	AUDIT_LOG = getEnv("AUDIT_LOG", "")
+	CONVERSATION_STORE = getEnv("CONVERSATION_STORE", "memory")
+	if CONVERSATION_STORE != "memory" && !strings.HasPrefix(CONVERSATION_STORE, "file:") {
+		configErrors = append(configErrors, fmt.Errorf("CONVERSATION_STORE must be memory or file:<path>, got %q", CONVERSATION_STORE))
+	}
+	CONVERSATION_TTL = getEnvDuration("CONVERSATION_TTL", 24*time.Hour)
+	ANON_BLOCKED_MODELS = map[string]bool{}
+	for _, model := range strings.Split(getEnv("ANON_BLOCKED_MODELS", ""), ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			ANON_BLOCKED_MODELS[model] = true
+		}
+	}
+	API_KEYS = map[string]bool{DEFAULT_KEY: true}
+	for _, key := range strings.Split(getEnv("API_KEYS", ""), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			API_KEYS[key] = true
+		}
+	}
 	PORT = getEnv("PORT", "8080")
 
-	modelMapStr := getEnv("MODEL_MAP", "GLM-4.5:0727-360B-API,GLM-4.5V:glm-4.5v")
-	MODEL_MAP = make(map[string]string)
-	pairs := strings.Split(modelMapStr, ",")
-	for _, pair := range pairs {
-		kv := strings.SplitN(pair, ":", 2)
-		if len(kv) == 2 {
-			key := strings.TrimSpace(kv[0])
-			value := strings.TrimSpace(kv[1])
-			if key != "" && value != "" {
-				MODEL_MAP[key] = value
-			}
+	MODEL_MAP = parsePairs("MODEL_MAP", getEnv("MODEL_MAP", "GLM-4.5:0727-360B-API,GLM-4.5V:glm-4.5v"))
+	MODEL_OWNED_BY = parsePairs("MODEL_OWNED_BY", getEnv("MODEL_OWNED_BY", ""))
+	MODEL_STREAM = make(map[string]bool)
+	for name, value := range parsePairs("MODEL_STREAM", getEnv("MODEL_STREAM", "")) {
+		MODEL_STREAM[name] = value == "true"
+	}
+	MODEL_RATE_LIMITS = make(map[string]int)
+	for name, value := range parsePairs("MODEL_RATE_LIMITS", getEnv("MODEL_RATE_LIMITS", "")) {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			configErrors = append(configErrors, fmt.Errorf("MODEL_RATE_LIMITS entry for %s must be a positive number of requests per minute, got %q", name, value))
+			continue
+		}
+		MODEL_RATE_LIMITS[name] = limit
+		modelLimiters[name] = newTokenBucket(limit)
+	}
+	MODEL_TOKENIZER = parsePairs("MODEL_TOKENIZER", getEnv("MODEL_TOKENIZER", ""))
+	for name, value := range MODEL_TOKENIZER {
+		if _, ok := tokenizers[value]; !ok {
+			configErrors = append(configErrors, fmt.Errorf("MODEL_TOKENIZER entry for %s must be glm, gpt or generic, got %q", name, value))
 		}
 	}
 
@@ -61,6 +513,243 @@ func initConfig() {
 	}
 	DEBUG_MODE = getEnv("DEBUG_MODE", "true") == "true"
 	DEFAULT_STREAM = getEnv("DEFAULT_STREAM", "true") == "true"
+	THINK_TAGS_MODE = getEnv("THINK_TAGS_MODE", "strip")
+	STRIP_CODE_FENCES = getEnv("STRIP_CODE_FENCES", "false") == "true"
+	switch RETURN_PARTIAL_ON_TIMEOUT = getEnv("RETURN_PARTIAL_ON_TIMEOUT", ""); RETURN_PARTIAL_ON_TIMEOUT {
+	case "true":
+		RETURN_PARTIAL_ON_TIMEOUT = "length"
+	case "false":
+		RETURN_PARTIAL_ON_TIMEOUT = ""
+	}
+	DEDUPE_DELTAS = getEnv("DEDUPE_DELTAS", "false") == "true"
+
+	DRAIN_DELAY = getEnvDuration("DRAIN_DELAY", 5*time.Second)
+	SHUTDOWN_TIMEOUT = getEnvDuration("SHUTDOWN_TIMEOUT", 30*time.Second)
+
+	SLOW_REQUEST_THRESHOLD = getEnvDuration("SLOW_REQUEST_THRESHOLD", 0)
+
+	MAX_CONCURRENCY = getEnvInt("MAX_CONCURRENCY", 0)
+	KEY_PRIORITIES = parsePairs("KEY_PRIORITIES", getEnv("KEY_PRIORITIES", ""))
+	for key, class := range KEY_PRIORITIES {
+		if priorityIndex(class) < 0 {
+			configErrors = append(configErrors, fmt.Errorf("KEY_PRIORITIES for key %s must be one of %s, got %q", keyLabel(key), strings.Join(priorityClasses, ", "), class))
+		}
+	}
+
+	MAX_BEST_OF = getEnvInt("MAX_BEST_OF", 4)
+	BEST_OF_STRATEGY = getEnv("BEST_OF_STRATEGY", "longest")
+
+	MAX_MESSAGES = getEnvInt("MAX_MESSAGES", 0)
+	MAX_MESSAGES_MODE = getEnv("MAX_MESSAGES_MODE", "reject")
+	if MAX_MESSAGES_MODE != "reject" && MAX_MESSAGES_MODE != "trim" {
+		configErrors = append(configErrors, fmt.Errorf("MAX_MESSAGES_MODE must be reject or trim, got %q", MAX_MESSAGES_MODE))
+	}
+	MAX_IMAGES_PER_REQUEST = getEnvInt("MAX_IMAGES_PER_REQUEST", 0)
+
+	SSE_RESUME = getEnv("SSE_RESUME", "false") == "true"
+	SSE_RESUME_BUFFER = getEnvInt("SSE_RESUME_BUFFER", 1000)
+	SSE_RESUME_TTL = getEnvDuration("SSE_RESUME_TTL", 5*time.Minute)
+	SSE_RETRY = getEnvDuration("SSE_RETRY", 3*time.Second)
+	SSE_EXTRA_NEWLINE = getEnv("SSE_EXTRA_NEWLINE", "false") == "true"
+
+	LEGACY_FUNCTION_CALL = getEnv("LEGACY_FUNCTION_CALL", "true") == "true"
+	TOOL_CALL_DETECTION = getEnv("TOOL_CALL_DETECTION", "false") == "true"
+
+	CHUNK_SIZE = getEnvInt("CHUNK_SIZE", 1024)
+
+	TEMPERATURE_RANGE = getEnvRange("TEMPERATURE_RANGE", [2]float64{0, 2})
+	TOP_P_RANGE = getEnvRange("TOP_P_RANGE", [2]float64{0, 1})
+	TEMPERATURE_ZERO_EPSILON = getEnv("TEMPERATURE_ZERO_EPSILON", "")
+	if TEMPERATURE_ZERO_EPSILON != "" && TEMPERATURE_ZERO_EPSILON != "omit" {
+		if _, err := strconv.ParseFloat(TEMPERATURE_ZERO_EPSILON, 64); err != nil {
+			configErrors = append(configErrors, fmt.Errorf("TEMPERATURE_ZERO_EPSILON must be a number or \"omit\", got %q", TEMPERATURE_ZERO_EPSILON))
+		}
+	}
+
+	getEnvJSON("RESPONSE_HEADERS", &RESPONSE_HEADERS)
+
+	PROGRESS_INTERVAL = getEnvDuration("PROGRESS_INTERVAL", 5*time.Second)
+
+	getEnvJSON("FALLBACK_MODELS", &FALLBACK_MODELS)
+
+	LANGUAGE_ROUTING = parsePairs("LANGUAGE_ROUTING", getEnv("LANGUAGE_ROUTING", ""))
+
+	IDEMPOTENCY_TTL = getEnvDuration("IDEMPOTENCY_TTL", 10*time.Minute)
+	IDEMPOTENCY_MAX_ENTRIES = getEnvInt("IDEMPOTENCY_MAX_ENTRIES", 1000)
+	IDEMPOTENCY_MAX_BYTES = getEnvInt("IDEMPOTENCY_MAX_BYTES", 1<<20)
+	COALESCE_ENABLED = getEnv("COALESCE_ENABLED", "false") == "true"
+
+	getEnvJSON("MODEL_METADATA", &MODEL_METADATA)
+	getEnvJSON("MODEL_PARAMS", &MODEL_PARAMS)
+
+	LOG_CONTENT_MAX = getEnvInt("LOG_CONTENT_MAX", 200)
+
+	ADMIN_KEY = getEnv("ADMIN_KEY", "")
+
+	EVENT_REASSEMBLY_MAX_BYTES = getEnvInt("EVENT_REASSEMBLY_MAX_BYTES", 1<<20)
+
+	MAX_BATCH_SIZE = getEnvInt("MAX_BATCH_SIZE", 16)
+
+	LOGPROBS_UNSUPPORTED = getEnv("LOGPROBS_UNSUPPORTED", "null")
+	IMAGE_ON_TEXT_MODEL = getEnv("IMAGE_ON_TEXT_MODEL", "reject")
+	STREAM_UNSUPPORTED_MODE = getEnv("STREAM_UNSUPPORTED_MODE", "error")
+	CONTEXT_LENGTH_CHECK = getEnv("CONTEXT_LENGTH_CHECK", "false") == "true"
+
+	MAX_OUTPUT_TOKENS_CAP = getEnvInt("MAX_OUTPUT_TOKENS_CAP", 0)
+	MAX_THINKING_TOKENS = getEnvInt("MAX_THINKING_TOKENS", 0)
+	TRIM_TRAILING = getEnv("TRIM_TRAILING", "false") == "true"
+
+	UPSTREAM_CHAT_ID_FIELD = getEnv("UPSTREAM_CHAT_ID_FIELD", "false") == "true"
+	UPSTREAM_MODEL_HEADER = getEnv("UPSTREAM_MODEL_HEADER", "false") == "true"
+
+	SYSTEM_FINGERPRINT = getEnv("SYSTEM_FINGERPRINT", "")
+
+	PLUGIN_CMD = getEnv("PLUGIN_CMD", "")
+	PLUGIN_TIMEOUT = getEnvDuration("PLUGIN_TIMEOUT", 5*time.Second)
+
+	MODERATION_URL = getEnv("MODERATION_URL", "")
+	MODERATION_TIMEOUT = getEnvDuration("MODERATION_TIMEOUT", 2*time.Second)
+	MODERATION_FAIL_MODE = getEnv("MODERATION_FAIL_MODE", "open")
+	if !contains([]string{"open", "closed"}, MODERATION_FAIL_MODE) {
+		configErrors = append(configErrors, fmt.Errorf("MODERATION_FAIL_MODE must be open or closed, got %q", MODERATION_FAIL_MODE))
+	}
+
+	if pattern := getEnv("OUTPUT_TRIM_LEADING", ""); pattern != "" {
+		re, err := regexp.Compile(`^(?:` + pattern + `)`)
+		if err != nil {
+			configErrors = append(configErrors, fmt.Errorf("OUTPUT_TRIM_LEADING is not a valid regular expression: %v", err))
+		}
+		OUTPUT_TRIM_LEADING = re
+	}
+
+	var redactPatterns []string
+	getEnvJSON("REDACT_PATTERNS", &redactPatterns)
+	for _, pattern := range redactPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			configErrors = append(configErrors, fmt.Errorf("REDACT_PATTERNS entry %q is not a valid regular expression: %v", pattern, err))
+			continue
+		}
+		REDACT_PATTERNS = append(REDACT_PATTERNS, re)
+	}
+	REDACT_PLACEHOLDER = getEnv("REDACT_PLACEHOLDER", "[REDACTED]")
+}
+
+// validateConfig reports configuration that would make every request fail.
+func validateConfig() error {
+	if len(configErrors) > 0 {
+		return errors.Join(configErrors...)
+	}
+	if len(MODEL_MAP) == 0 {
+		return errors.New("MODEL_MAP contains no valid entries")
+	}
+	if err := validateUpstreamURL(); err != nil {
+		return err
+	}
+	switch THINK_TAGS_MODE {
+	case "strip", "think", "raw":
+	default:
+		return fmt.Errorf("THINK_TAGS_MODE must be strip, think or raw, got %q", THINK_TAGS_MODE)
+	}
+	for model, chain := range FALLBACK_MODELS {
+		for _, fallback := range append([]string{model}, chain...) {
+			if _, ok := MODEL_MAP[fallback]; !ok {
+				return fmt.Errorf("FALLBACK_MODELS refers to %q, which is not in MODEL_MAP", fallback)
+			}
+		}
+	}
+	for key, models := range KEY_MODEL_ACL {
+		for _, model := range models {
+			if _, ok := MODEL_MAP[model]; !ok && model != "*" {
+				return fmt.Errorf("KEY_MODEL_ACL for key %s refers to %q, which is not in MODEL_MAP", keyLabel(key), model)
+			}
+		}
+	}
+	for lang, model := range LANGUAGE_ROUTING {
+		if _, ok := MODEL_MAP[model]; !ok {
+			return fmt.Errorf("LANGUAGE_ROUTING routes %q to %q, which is not in MODEL_MAP", lang, model)
+		}
+	}
+	switch IMAGE_ON_TEXT_MODEL {
+	case "reject", "strip", "route":
+	default:
+		return fmt.Errorf("IMAGE_ON_TEXT_MODEL must be reject, strip or route, got %q", IMAGE_ON_TEXT_MODEL)
+	}
+	if LOGPROBS_UNSUPPORTED != "null" && LOGPROBS_UNSUPPORTED != "error" {
+		return fmt.Errorf("LOGPROBS_UNSUPPORTED must be null or error, got %q", LOGPROBS_UNSUPPORTED)
+	}
+	if STREAM_UNSUPPORTED_MODE != "error" && STREAM_UNSUPPORTED_MODE != "buffer" {
+		return fmt.Errorf("STREAM_UNSUPPORTED_MODE must be error or buffer, got %q", STREAM_UNSUPPORTED_MODE)
+	}
+	if _, ok := bestOfScorers[BEST_OF_STRATEGY]; !ok {
+		return fmt.Errorf("BEST_OF_STRATEGY must be longest or shortest, got %q", BEST_OF_STRATEGY)
+	}
+	if !ANON_TOKEN_ENABLED && UPSTREAM_TOKEN == "" {
+		return errors.New("UPSTREAM_TOKEN must be set when the anonymous token is disabled")
+	}
+	return nil
+}
+
+// parsePairs parses a "name:value,name:value" list from the setting source.
+// The value may contain further colons; a backslash escapes a comma, colon
+// or backslash in either part. Malformed and duplicate entries are logged
+// rather than silently dropped; values are left out of the log, as some
+// settings hold secrets.
+func parsePairs(source, str string) map[string]string {
+	result := make(map[string]string)
+	for i, pair := range splitUnescaped(str, ',', -1) {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := splitUnescaped(pair, ':', 2)
+		if len(kv) != 2 {
+			log.Printf("Warning: ignoring %s entry %d: expected name:value but found no ':'", source, i+1)
+			continue
+		}
+		key := unescapePair(strings.TrimSpace(kv[0]))
+		value := unescapePair(strings.TrimSpace(kv[1]))
+		switch {
+		case key == "" || value == "":
+			log.Printf("Warning: ignoring %s entry %d (%q): name and value must not be empty", source, i+1, key)
+			continue
+		case result[key] != "":
+			log.Printf("Warning: %s entry %d redefines %q, the last definition wins", source, i+1, key)
+		}
+		result[key] = value
+	}
+	return result
+}
+
+// splitUnescaped splits s at each sep not preceded by a backslash, into at
+// most n parts (all of them when n < 0). Escapes are kept for unescapePair.
+func splitUnescaped(s string, sep byte, n int) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == sep && (n < 0 || len(parts) < n-1):
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapePair drops the backslash of each escape in s.
+func unescapePair(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
 }
 
 func getEnv(key, defaultValue string) string {
@@ -70,18 +759,210 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %d", key, value, defaultValue)
+		return defaultValue
+	}
+	return n
+}
+
+// getEnvRange parses an inclusive "min,max" range.
+func getEnvRange(key string, defaultValue [2]float64) [2]float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	loStr, hiStr, ok := strings.Cut(value, ",")
+	lo, errLo := strconv.ParseFloat(strings.TrimSpace(loStr), 64)
+	hi, errHi := strconv.ParseFloat(strings.TrimSpace(hiStr), 64)
+	if !ok || errLo != nil || errHi != nil || lo > hi {
+		log.Printf("Invalid %s=%q, using default %v,%v", key, value, defaultValue[0], defaultValue[1])
+		return defaultValue
+	}
+	return [2]float64{lo, hi}
+}
+
+// getEnvJSON decodes a JSON-valued variable into target, recording a config
+// error if it does not parse.
+func getEnvJSON(key string, target interface{}) {
+	value := os.Getenv(key)
+	if value == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(value), target); err != nil {
+		configErrors = append(configErrors, fmt.Errorf("%s is not valid JSON: %v", key, err))
+	}
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s=%q, using default %s", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
 // Structs
 type OpenAIRequest struct {
 	Model       string    `json:"model"`
 	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream,omitempty"`
-	Temperature float64   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
+	Stream      *bool     `json:"stream,omitempty"`
+	Temperature *float64  `json:"temperature,omitempty"`
+	TopP        *float64  `json:"top_p,omitempty"`
+	MaxTokens   *int      `json:"max_tokens,omitempty"`
+
+	// Penalties left unset default to the model's MODEL_PARAMS.
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	N              int             `json:"n,omitempty"`
+	BestOf         int             `json:"best_of,omitempty"`
+
+	Tools             []json.RawMessage `json:"tools,omitempty"`
+	ToolChoice        interface{}       `json:"tool_choice,omitempty"`
+	ParallelToolCalls *bool             `json:"parallel_tool_calls,omitempty"`
+
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+
+	Logprobs    bool `json:"logprobs,omitempty"`
+	TopLogprobs *int `json:"top_logprobs,omitempty"`
+
+	// Prediction (predicted outputs) is forwarded only to models with the
+	// "prediction" capability and otherwise dropped.
+	Prediction json.RawMessage `json:"prediction,omitempty"`
+
+	// WebSearch enables the upstream's web search; a {"type":"web_search"}
+	// tool does the same.
+	WebSearch bool `json:"web_search,omitempty"`
+
+	// Features override UPSTREAM_FEATURES for this request.
+	Features map[string]interface{} `json:"features,omitempty"`
+
+	// Store and Metadata are the client's own record-keeping fields. They
+	// are not forwarded; Metadata is written to AUDIT_LOG.
+	Store    *bool             `json:"store,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// ExtraBody is merged into the upstream request when
+	// ALLOW_CLIENT_EXTRA_BODY is set, and ignored otherwise.
+	ExtraBody map[string]interface{} `json:"extra_body,omitempty"`
+
+	// Modalities are the requested output modalities. Only ones the model
+	// supports are accepted; they are not forwarded upstream.
+	Modalities []string `json:"modalities,omitempty"`
+
+	// IncludeReasoning overrides THINK_TAGS_MODE for this request: true
+	// shows the reasoning, false strips it. X-Think-Mode takes precedence.
+	IncludeReasoning *bool `json:"include_reasoning,omitempty"`
+
+	// streamProgress is set from the X-Stream-Progress request header.
+	streamProgress bool
+	// upstreamChatID is the chat_id the upstream served this request under.
+	upstreamChatID string
+	// apiKey is the caller's key, for budget accounting.
+	apiKey string
+	// usage is what recordUsage charged, for the audit record.
+	usage *Usage
+	// requestID is the client's X-Request-ID, or one we generated, sent to
+	// the upstream for correlation.
+	requestID string
+	// clientIP is the caller's address, only resolved with FORWARD_CLIENT_IP.
+	clientIP string
+	// omitFields are left out of the response; see omitFields.
+	omitFields []string
+	// thinkMode is the THINK_TAGS_MODE for this request; see
+	// requestThinkMode.
+	thinkMode string
+	// conversationID is the X-Conversation-ID header, whose turns share one
+	// upstream chat_id.
+	conversationID string
+	// modelScopes are the JWT caller's scopes, checked by modelDenied.
+	modelScopes []string
+	// webSocket marks a request made on /v1/chat/completions/ws, which
+	// cannot be resumed and so is never detached for SSE_RESUME.
+	webSocket bool
+	// timings feed the SLOW_REQUEST_THRESHOLD log.
+	timings requestTimings
+	// span is the request's trace span, nil unless tracing is enabled.
+	span *span
+	// ctx ends the upstream calls when the client goes away or the
+	// REQUEST_DEADLINE passes.
+	ctx context.Context
+
+	// Legacy function calling, superseded by tools
+	Functions    []json.RawMessage `json:"functions,omitempty"`
+	FunctionCall interface{}       `json:"function_call,omitempty"`
+}
+
+// usesLegacyFunctions reports whether the response should use the legacy
+// function_call shape instead of tool_calls.
+func (r *OpenAIRequest) usesLegacyFunctions() bool {
+	return LEGACY_FUNCTION_CALL && len(r.Functions) > 0 && len(r.Tools) == 0
+}
+
+// allowsParallelToolCalls defaults to true, as in the OpenAI API.
+func (r *OpenAIRequest) allowsParallelToolCalls() bool {
+	return r.ParallelToolCalls == nil || *r.ParallelToolCalls
+}
+
+// bestOf is the number of upstream candidates to generate for this request.
+func (r *OpenAIRequest) bestOf() int {
+	return max(r.BestOf, r.N, 1)
+}
+
+// choices is the number of choices to return.
+func (r *OpenAIRequest) choices() int {
+	return max(r.N, 1)
+}
+
+type StreamOptions struct {
+	IncludeUsage         bool `json:"include_usage,omitempty"`
+	ContinuousUsageStats bool `json:"continuous_usage_stats,omitempty"`
+}
+
+type ResponseFormat struct {
+	Type string `json:"type"`
+}
+
+// wantsJSON reports whether the client asked for a JSON response_format.
+func (r *OpenAIRequest) wantsJSON() bool {
+	return r.ResponseFormat != nil && (r.ResponseFormat.Type == "json_object" || r.ResponseFormat.Type == "json_schema")
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role         string        `json:"role"`
+	Content      string        `json:"content"`
+	ToolCalls    []ToolCall    `json:"tool_calls,omitempty"`
+	ToolCallID   string        `json:"tool_call_id,omitempty"`
+	FunctionCall *FunctionCall `json:"function_call,omitempty"`
+	Annotations  []Annotation  `json:"annotations,omitempty"`
+
+	// Parts holds array-valued content; see Message.UnmarshalJSON.
+	Parts []ContentPart `json:"-"`
+}
+
+type ToolCall struct {
+	Index    *int         `json:"index,omitempty"`
+	ID       string       `json:"id"`
+	Type     string       `json:"type"`
+	Function FunctionCall `json:"function"`
+}
+
+type FunctionCall struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
 }
 
 type UpstreamRequest struct {
@@ -91,13 +972,25 @@ type UpstreamRequest struct {
 	Params          map[string]interface{} `json:"params"`
 	Features        map[string]interface{} `json:"features"`
 	BackgroundTasks map[string]bool        `json:"background_tasks,omitempty"`
-	ChatID          string                 `json:"chat_id,omitempty"`
-	ID              string                 `json:"id,omitempty"`
-	ModelItem       struct {
+	Tools           []json.RawMessage      `json:"tools,omitempty"`
+	ToolChoice      interface{}            `json:"tool_choice,omitempty"`
+	// ParallelToolCalls is forwarded as-is; z.ai may ignore it, so the
+	// translator also enforces it on the calls it returns.
+	ParallelToolCalls *bool  `json:"parallel_tool_calls,omitempty"`
+	ChatID            string `json:"chat_id,omitempty"`
+	ID                string `json:"id,omitempty"`
+	ModelItem         struct {
 		ID      string `json:"id"`
 		Name    string `json:"name"`
 		OwnedBy string `json:"owned_by"`
 	} `json:"model_item,omitempty"`
+
+	// extraBody is deep-merged into the marshalled request by callUpstream.
+	extraBody map[string]interface{}
+	// clientIP is sent in the FORWARD_CLIENT_IP header when set.
+	clientIP string
+	// ctx bounds the upstream call; nil means no deadline.
+	ctx context.Context
 }
 
 type OpenAIResponse struct {
@@ -106,18 +999,39 @@ type OpenAIResponse struct {
 	Created int64    `json:"created"`
 	Model   string   `json:"model"`
 	Choices []Choice `json:"choices"`
+	Usage   *Usage   `json:"usage,omitempty"`
+
+	SystemFingerprint string `json:"system_fingerprint,omitempty"`
+
+	// UpstreamChatID is an extension field, set with UPSTREAM_CHAT_ID_FIELD.
+	UpstreamChatID string `json:"x_upstream_chat_id,omitempty"`
 }
 
 type Choice struct {
-	Index        int     `json:"index"`
-	Message      Message `json:"message,omitempty"`
-	Delta        Delta   `json:"delta,omitempty"`
-	FinishReason string  `json:"finish_reason,omitempty"`
+	Index        int       `json:"index"`
+	Message      *Message  `json:"message,omitempty"`
+	Delta        *Delta    `json:"delta,omitempty"`
+	Logprobs     *Logprobs `json:"logprobs,omitempty"`
+	FinishReason string    `json:"finish_reason,omitempty"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
 }
 
 type Delta struct {
-	Role    string `json:"role,omitempty"`
-	Content string `json:"content,omitempty"`
+	Role string `json:"role,omitempty"`
+	// Content is a pointer so the opening role chunk can carry "".
+	Content      *string       `json:"content,omitempty"`
+	ToolCalls    []ToolCall    `json:"tool_calls,omitempty"`
+	FunctionCall *FunctionCall `json:"function_call,omitempty"`
+	Annotations  []Annotation  `json:"annotations,omitempty"`
+
+	// Parts is non-text output, sent as array-valued content; see
+	// Delta.MarshalJSON.
+	Parts []ContentPart `json:"-"`
 }
 
 type ModelsResponse struct {
@@ -138,6 +1052,25 @@ func debugLog(format string, args ...interface{}) {
 	}
 }
 
+// modelOwner is the owned_by reported for a client-facing model name.
+func modelOwner(name string) string {
+	if owner, ok := MODEL_OWNED_BY[name]; ok {
+		return owner
+	}
+	return "z.ai"
+}
+
+// systemFingerprint identifies the backend configuration serving model:
+// SYSTEM_FINGERPRINT if set, otherwise a hash of the upstream model and the
+// settings that change its output, so it only changes when those do.
+func systemFingerprint(model string) string {
+	if SYSTEM_FINGERPRINT != "" {
+		return SYSTEM_FINGERPRINT
+	}
+	sum := sha256.Sum256([]byte(strings.Join([]string{MODEL_MAP[model], feVersion.current(), THINK_TAGS_MODE, strconv.FormatBool(STRIP_CODE_FENCES)}, "\x00")))
+	return "fp_" + hex.EncodeToString(sum[:5])
+}
+
 func getModelNames() []string {
 	names := make([]string, 0, len(MODEL_MAP))
 	for name := range MODEL_MAP {
@@ -147,8 +1080,8 @@ func getModelNames() []string {
 }
 
 func getAnonymousToken() (string, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest("GET", ORIGIN_BASE+"/api/v1/auths/", nil)
+	client := &http.Client{Timeout: 10 * time.Second, Transport: upstreamTransport}
+	req, err := http.NewRequest("GET", ANON_TOKEN_URL, nil)
 	if err != nil { return "", err }
 	req.Header.Set("User-Agent", BROWSER_UA)
 	req.Header.Set("Accept", "*/*")
@@ -158,133 +1091,1231 @@ func getAnonymousToken() (string, error) {
 	if err != nil { return "", err }
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK { return "", fmt.Errorf("anon token status=%d", resp.StatusCode) }
-	var body struct { Token string `json:"token"` }
+	var body map[string]interface{}
 	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil { return "", err }
-	if body.Token == "" { return "", fmt.Errorf("anon token empty") }
-	return body.Token, nil
+	token := lookupTokenField(body, ANON_TOKEN_FIELD)
+	if token == "" { return "", fmt.Errorf("anon token field %q empty", ANON_TOKEN_FIELD) }
+	return token, nil
 }
 
-func main() {
-	initConfig()
-	http.HandleFunc("/v1/models", handleModels)
-	http.HandleFunc("/v1/chat/completions", handleChatCompletions)
-	http.HandleFunc("/", handleOptions)
-	log.Printf("Server starting on port %s", PORT)
-	log.Printf("Upstream: %s", UPSTREAM_URL)
-	log.Printf("Supported Models: %v", getModelNames())
-	log.Fatal(http.ListenAndServe(PORT, nil))
+// lookupTokenField resolves a dotted field path such as "data.token".
+func lookupTokenField(body map[string]interface{}, path string) string {
+	var cur interface{} = body
+	for _, part := range strings.Split(path, ".") {
+		obj, ok := cur.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		cur = obj[part]
+	}
+	token, _ := cur.(string)
+	return token
 }
 
-func handleOptions(w http.ResponseWriter, r *http.Request) {
-	setCORSHeaders(w)
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
-		return
+// Lifecycle state shared by the probes and the shutdown path
+var (
+	serverReady    atomic.Bool
+	serverDraining atomic.Bool
+	inFlight       atomic.Int64
+)
+
+var scheduler *fairScheduler
+
+func initMetrics() {
+	registerCounter("z2api_requests_total", "Chat completion requests by model and key.")
+	registerCounter("z2api_stream_errors_total", "Streams that failed after the response had started, by model.")
+	registerCounter("z2api_fallbacks_total", "Requests served by a fallback model, by requested and serving model.")
+	registerCounter("z2api_stream_duration_exceeded_total", "Streams cut off by MAX_STREAM_DURATION, by model.")
+	registerCounter("z2api_moderation_total", "MODERATION_URL verdicts, by result (allow, deny or error).")
+	registerCounter("z2api_model_throttled_total", "Requests rejected by MODEL_RATE_LIMITS, by model.")
+	registerCounter("z2api_coalesced_requests_total", "Chat requests served from an identical request already in flight.")
+	registerCounter("z2api_fe_version_rejections_total", "Upstream rejections of X-FE-Version, by whether a refreshed version was retried.")
+	registerGauge("z2api_queue_depth", "Requests waiting for a concurrency slot, per key.", scheduler.queueDepths)
+	registerGauge("z2api_queue_depth_by_class", "Requests waiting for a concurrency slot, per priority class.", scheduler.classDepths)
+	registerGauge("z2api_running_requests", "Requests currently holding a concurrency slot.", scheduler.runningCount)
+	if len(upstreamTokens.tokens) > 0 {
+		registerGauge("z2api_upstream_token_healthy", "Whether each UPSTREAM_TOKEN is in rotation (1) or quarantined (0).", upstreamTokens.healthGauge)
+	}
+	if UPSTREAM_PING_INTERVAL > 0 {
+		registerGauge("z2api_upstream_up", "Whether the last UPSTREAM_PING_URL probe succeeded.", upstreamPing.up)
 	}
-	w.WriteHeader(http.StatusNotFound)
 }
 
-func setCORSHeaders(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+func main() {
+	initConfig()
+	if err := validateConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	if BUDGET_FILE != "" {
+		if err := loadBudgets(); err != nil {
+			log.Fatalf("Failed to load budgets from %s: %v", BUDGET_FILE, err)
+		}
+	}
+	if AUDIT_LOG != "" {
+		if err := openAuditLog(); err != nil {
+			log.Fatalf("Failed to open AUDIT_LOG %s: %v", AUDIT_LOG, err)
+		}
+	}
+	if path, ok := strings.CutPrefix(CONVERSATION_STORE, "file:"); ok {
+		if err := loadConversations(path); err != nil {
+			log.Fatalf("Failed to load conversations from %s: %v", path, err)
+		}
+	}
+	scheduler = newFairScheduler(MAX_CONCURRENCY)
+	initMetrics()
+	initTracing()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", handleHealth)
+	mux.HandleFunc("/ready", handleReady)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/v1/models", handleModels)
+	mux.HandleFunc("/v1/chat/completions", traceRequests("chat.completions", handleChatCompletions))
+	mux.HandleFunc("/v1/chat/completions/ws", traceRequests("chat.completions.ws", handleChatCompletionsWS))
+	mux.HandleFunc("/v1/chat/completions/batch", traceRequests("chat.completions.batch", handleBatchCompletions))
+	mux.HandleFunc("/v1/responses", traceRequests("responses", handleResponses))
+	mux.HandleFunc("/admin/test", handleAdminTest)
+	mux.HandleFunc("/debug/raw", handleDebugRaw)
+	mux.HandleFunc("/debug/config", handleDebugConfig)
+	if ENABLE_UI {
+		mux.HandleFunc("/ui", handleUI)
+	}
+	mux.HandleFunc("/", handleRoot)
+	srv := &http.Server{Addr: PORT, Handler: trackInFlight(withResponseHeaders(withGzip(withCharset(mux))))}
+
+	go warmup()
+	if UPSTREAM_PING_INTERVAL > 0 {
+		go pingUpstream()
+	}
+
+	log.Printf("Server starting on port %s", PORT)
+	log.Printf("Upstream: %s", UPSTREAM_URL)
+	names := getModelNames()
+	sort.Strings(names)
+	log.Printf("Supported Models: %v", names)
+	for _, name := range names {
+		log.Printf("  %s -> upstream %s", name, MODEL_MAP[name])
+	}
+	features, _ := json.Marshal(UPSTREAM_FEATURES)
+	log.Printf("Upstream features: %s", features)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		drainAndShutdown(srv)
+	}()
+
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-done
+}
+
+// acquireAuthToken picks the upstream token for model: the static
+// UPSTREAM_TOKEN when configured, otherwise an anonymous token, retried a few
+// times. It fails rather than returning an empty token.
+func acquireAuthToken(model string) (string, error) {
+	if UPSTREAM_TOKEN != "" {
+		return upstreamTokens.pick(), nil
+	}
+	if ANON_BLOCKED_MODELS[model] {
+		return "", &anonBlockedError{model}
+	}
+	if !ANON_TOKEN_ENABLED {
+		return "", errors.New("UPSTREAM_TOKEN is not set and the anonymous token is disabled")
+	}
+	var err error
+	backoff := 200 * time.Millisecond
+	for attempt := 0; attempt <= ANON_TOKEN_RETRIES; attempt++ {
+		if attempt > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		var token string
+		if token, err = anonTokens.get(anonTokenScope(model)); err == nil {
+			return token, nil
+		}
+		log.Printf("Anonymous token attempt %d/%d failed: %v", attempt+1, ANON_TOKEN_RETRIES+1, err)
+	}
+	return "", fmt.Errorf("UPSTREAM_TOKEN is not set and the anonymous token is unavailable: %v", err)
+}
+
+// anonBlockedError means the model is listed in ANON_BLOCKED_MODELS and no
+// UPSTREAM_TOKEN is configured.
+type anonBlockedError struct {
+	model string
+}
+
+func (e *anonBlockedError) Error() string {
+	return fmt.Sprintf("model %s requires an authenticated upstream token (UPSTREAM_TOKEN), which is not configured", e.model)
+}
+
+// warmup pre-fetches the anonymous token into the cache so the first request
+// does not pay for it, and marks the server ready once that succeeded. With
+// warmup disabled (or a static token) the server is ready right away.
+func warmup() {
+	if UPSTREAM_TOKEN != "" || !ANON_TOKEN_ENABLED || !ANON_TOKEN_WARMUP {
+		serverReady.Store(true)
+		return
+	}
+	backoff := time.Second
+	for !serverDraining.Load() {
+		var err error
+		for _, scope := range anonTokenScopes() {
+			if _, err = anonTokens.get(scope); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			serverReady.Store(true)
+			log.Printf("Anonymous token warmed up, server is ready")
+			return
+		}
+		log.Printf("Warmup: anonymous token fetch failed: %v (retrying in %s)", err, backoff)
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+// drainAndShutdown flips /ready to 503, gives load balancers DRAIN_DELAY to
+// notice, then waits up to SHUTDOWN_TIMEOUT for in-flight requests.
+func drainAndShutdown(srv *http.Server) {
+	serverDraining.Store(true)
+	log.Printf("Shutdown requested, draining (%d requests in flight)", inFlight.Load())
+	time.Sleep(DRAIN_DELAY)
+
+	ctx, cancel := context.WithTimeout(context.Background(), SHUTDOWN_TIMEOUT)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if traceExporter != nil {
+		traceExporter.flush()
+	}
+	if err != nil {
+		log.Printf("Shutdown incomplete, %d requests still in flight: %v", inFlight.Load(), err)
+		return
+	}
+	log.Printf("Server stopped")
+}
+
+// withResponseHeaders applies RESPONSE_HEADERS to every response. They are
+// set when the status line is written, after the handler's own headers, so
+// handlers cannot clobber them.
+func withResponseHeaders(next http.Handler) http.Handler {
+	if len(RESPONSE_HEADERS) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headerWriter{ResponseWriter: w}, r)
+	})
+}
+
+type headerWriter struct {
+	http.ResponseWriter
+	applied bool
+}
+
+func (h *headerWriter) apply() {
+	if h.applied {
+		return
+	}
+	h.applied = true
+	for name, value := range RESPONSE_HEADERS {
+		h.Header().Set(name, value)
+	}
+}
+
+func (h *headerWriter) WriteHeader(status int) {
+	h.apply()
+	h.ResponseWriter.WriteHeader(status)
+}
+
+func (h *headerWriter) Write(b []byte) (int, error) {
+	h.apply()
+	return h.ResponseWriter.Write(b)
+}
+
+func (h *headerWriter) Flush() {
+	h.apply()
+	if f, ok := h.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (h *headerWriter) Unwrap() http.ResponseWriter {
+	return h.ResponseWriter
+}
+
+func trackInFlight(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight.Add(1)
+		defer inFlight.Add(-1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleHealth is a pure liveness check: it succeeds as long as the process
+// is serving HTTP.
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	health := map[string]interface{}{"status": "ok"}
+	if len(upstreamTokens.tokens) > 1 {
+		health["upstream_tokens"] = upstreamTokens.states()
+	}
+	if UPSTREAM_PING_INTERVAL > 0 {
+		upstream := upstreamPing.status()
+		health["upstream"] = upstream
+		if upstream["status"] == "degraded" {
+			health["status"] = "degraded"
+		}
+	}
+	json.NewEncoder(w).Encode(health)
+}
+
+// handleReady reports whether new traffic should be routed here.
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	status := "ready"
+	switch {
+	case serverDraining.Load():
+		status = "draining"
+	case !serverReady.Load():
+		status = "starting"
+	}
+	if status != "ready" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": status, "in_flight": inFlight.Load()})
+}
+
+func handleOptions(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+func setCORSHeaders(w http.ResponseWriter) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+}
+
+// ErrorResponse is the OpenAI error envelope.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Message string  `json:"message"`
+	Type    string  `json:"type"`
+	Param   *string `json:"param"`
+	Code    *string `json:"code"`
+}
+
+// writeError replies with an OpenAI-style error envelope. An empty code is
+// sent as null.
+func writeError(w http.ResponseWriter, status int, message, errType, code string) {
+	detail := ErrorDetail{Message: message, Type: errType}
+	if code != "" {
+		detail.Code = &code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: detail})
+}
+
+func stringPtr(s string) *string {
+	return &s
+}
+
+// writeInvalidParam reports a 400 invalid_request_error naming the field.
+func writeInvalidParam(w http.ResponseWriter, param, message string) {
+	writeParamError(w, param, "", message)
+}
+
+// writeParamError is writeInvalidParam with an error code; an empty code is
+// sent as null.
+func writeParamError(w http.ResponseWriter, param, code, message string) {
+	detail := ErrorDetail{Message: message, Type: "invalid_request_error", Param: &param}
+	if code != "" {
+		detail.Code = &code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(ErrorResponse{Error: detail})
 }
 
 func handleModels(w http.ResponseWriter, r *http.Request) {
 	setCORSHeaders(w)
-	var models []Model
-	for name := range MODEL_MAP {
-		models = append(models, Model{ID: name, Object: "model", Created: time.Now().Unix(), OwnedBy: "z.ai"})
+	// ?capability= keeps only models whose metadata lists it; an unknown
+	// capability matches nothing.
+	capability := r.URL.Query().Get("capability")
+	names, ok := visibleModels(w, r)
+	if !ok {
+		return
+	}
+	models := []Model{}
+	for _, name := range names {
+		if capability != "" && !modelInfo(name).hasCapability(capability) {
+			continue
+		}
+		models = append(models, Model{ID: name, Object: "model", Created: time.Now().Unix(), OwnedBy: modelOwner(name)})
 	}
 	json.NewEncoder(w).Encode(ModelsResponse{Object: "list", Data: models})
 }
 
 func handleChatCompletions(w http.ResponseWriter, r *http.Request) {
 	setCORSHeaders(w)
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not supported on this endpoint; send a POST request with a JSON chat completion body", r.Method), "invalid_request_error", "method_not_allowed")
+		return
+	}
 
-	// Auth check
-	if strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ") != DEFAULT_KEY {
-		http.Error(w, "Invalid API key", http.StatusUnauthorized)
+	apiKey, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+	if SSE_RESUME && resumeStream(w, r, apiKey) {
 		return
 	}
+	if key := r.Header.Get("Idempotency-Key"); key != "" && IDEMPOTENCY_TTL > 0 {
+		serveIdempotent(w, r, apiKey, key, serveChatCompletion)
+		return
+	}
+	if COALESCE_ENABLED {
+		serveCoalesced(w, r, apiKey, serveChatCompletion)
+		return
+	}
+	serveChatCompletion(w, r, apiKey)
+}
 
+// authenticate returns the caller's API key, replying 401 if it is not one
+// of API_KEYS. In the hmac and jwt AUTH_MODEs the caller's key id or token
+// subject stands in for the key.
+func authenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	switch AUTH_MODE {
+	case "hmac":
+		return authenticateHMAC(w, r)
+	case "jwt":
+		return authenticateJWT(w, r)
+	}
+	apiKey := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !API_KEYS[apiKey] {
+		writeError(w, http.StatusUnauthorized, "Invalid API key", "invalid_request_error", "invalid_api_key")
+		return "", false
+	}
+	return apiKey, true
+}
+
+// serveChatCompletion handles an authenticated chat completion request.
+func serveChatCompletion(w http.ResponseWriter, r *http.Request, apiKey string) {
 	// Read and parse request
 	var req OpenAIRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON", "invalid_request_error", "")
+		return
+	}
+	if param, msg := decodeChatRequest(body, &req); msg != "" {
+		writeDecodeError(w, param, msg)
+		return
+	}
+
+	req.streamProgress = r.Header.Get("X-Stream-Progress") == "true"
+
+	// ?model= is a convenience for clients that cannot set the body field; it
+	// only applies when the body names no mapped model.
+	if queryModel := r.URL.Query().Get("model"); queryModel != "" {
+		if _, ok := MODEL_MAP[req.Model]; !ok {
+			debugLog("Model %q from query overrides body model %q", queryModel, req.Model)
+			req.Model = queryModel
+		}
+	}
+	if param, msg := applyHeaderParams(r.Header, &req); param != "" {
+		writeInvalidParam(w, param, msg)
+		return
+	}
+	completeChat(w, r, apiKey, &req)
+}
+
+// applyHeaderParams takes temperature and max_tokens from the X-Temperature
+// and X-Max-Tokens headers, for clients such as webhooks and shell scripts
+// that cannot set body fields. Body values win; range checks are left to
+// validateSampling.
+func applyHeaderParams(header http.Header, req *OpenAIRequest) (param, msg string) {
+	if value := header.Get("X-Temperature"); value != "" && req.Temperature == nil {
+		temperature, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return "temperature", fmt.Sprintf("X-Temperature header must be a number, got %q", value)
+		}
+		req.Temperature = &temperature
+	}
+	if value := header.Get("X-Max-Tokens"); value != "" && req.MaxTokens == nil {
+		maxTokens, err := strconv.Atoi(value)
+		if err != nil {
+			return "max_tokens", fmt.Sprintf("X-Max-Tokens header must be an integer, got %q", value)
+		}
+		req.MaxTokens = &maxTokens
+	}
+	return "", ""
+}
+
+// requestThinkMode resolves the think mode of one request: a valid
+// X-Think-Mode header wins over include_reasoning, which wins over
+// THINK_TAGS_MODE. include_reasoning: true keeps raw mode if that is the
+// default and otherwise means think.
+func requestThinkMode(header string, req *OpenAIRequest) string {
+	if header != "" {
+		if contains([]string{"strip", "think", "raw"}, header) {
+			return header
+		}
+		debugLog("Ignoring unknown X-Think-Mode %q", header)
+	}
+	switch {
+	case req.IncludeReasoning == nil:
+		return THINK_TAGS_MODE
+	case !*req.IncludeReasoning:
+		return "strip"
+	case THINK_TAGS_MODE == "raw":
+		return "raw"
+	}
+	return "think"
+}
+
+// completeChat validates a decoded request and serves it from the upstream.
+func completeChat(w http.ResponseWriter, r *http.Request, apiKey string, req *OpenAIRequest) {
+	defer logSlowRequest(req, time.Now())
+	if REQUEST_DEADLINE > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), REQUEST_DEADLINE)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	if auditLog != nil {
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		w = sw
+		defer writeAudit(req, sw, time.Now())
+	}
+	req.span = spanFromContext(r.Context())
+	setDebugEcho(w, r, req)
+	req.apiKey = apiKey
+	req.requestID = r.Header.Get("X-Request-ID")
+	if req.requestID == "" {
+		req.requestID = newRequestID()
+	}
+	if FORWARD_CLIENT_IP != "" {
+		req.clientIP = clientIP(r)
+	}
+	omit, err := responseOmitFields(r.Header)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "")
+		return
+	}
+	req.omitFields = omit
+	if PLUGIN_CMD != "" {
+		if err := pluginRewriteRequest(r.Context(), req); err != nil {
+			log.Printf("%v", err)
+			writeError(w, http.StatusInternalServerError, "request plugin failed", "server_error", "plugin_error")
+			return
+		}
+	}
+	req.thinkMode = requestThinkMode(r.Header.Get("X-Think-Mode"), req)
+	req.conversationID = r.Header.Get("X-Conversation-ID")
+	req.ctx = r.Context()
+	// Check the model is mapped to an upstream ID
+	if _, ok := MODEL_MAP[req.Model]; !ok {
+		writeError(w, http.StatusBadRequest, "Unsupported model", "invalid_request_error", "model_not_found")
+		return
+	}
+	if AUTH_MODE == "jwt" {
+		scopes, ok := requestModelScopes(r)
+		if !ok {
+			writeError(w, http.StatusForbidden, "Invalid token", "invalid_request_error", "model_not_allowed")
+			return
+		}
+		req.modelScopes = scopes
+	}
+	if len(LANGUAGE_ROUTING) > 0 {
+		applyLanguageRouting(req)
+	}
+	if msg := validateMetadata(req.Metadata); msg != "" {
+		req.Metadata = nil // keep oversized metadata out of the audit log
+		writeInvalidParam(w, "metadata", msg)
+		return
+	}
+	applyModelParams(req)
+	takeWebSearchTool(req)
+	if param, msg := validateSampling(req); param != "" {
+		writeInvalidParam(w, param, msg)
+		return
+	}
+	if param, msg := validateLogprobs(req); param != "" {
+		writeInvalidParam(w, param, msg)
+		return
+	}
+	if MAX_OUTPUT_TOKENS_CAP > 0 && (req.MaxTokens == nil || *req.MaxTokens > MAX_OUTPUT_TOKENS_CAP) {
+		if req.MaxTokens != nil {
+			log.Printf("Clamping max_tokens %d to MAX_OUTPUT_TOKENS_CAP=%d for %s", *req.MaxTokens, MAX_OUTPUT_TOKENS_CAP, req.Model)
+		}
+		limit := MAX_OUTPUT_TOKENS_CAP
+		req.MaxTokens = &limit
+	}
+	if MAX_MESSAGES > 0 && len(req.Messages) > MAX_MESSAGES {
+		if MAX_MESSAGES_MODE == "reject" {
+			log.Printf("Rejecting %s request with %d messages (MAX_MESSAGES=%d)", req.Model, len(req.Messages), MAX_MESSAGES)
+			writeInvalidParam(w, "messages", fmt.Sprintf("Too many messages: %d, the maximum is %d", len(req.Messages), MAX_MESSAGES))
+			return
+		}
+		before := len(req.Messages)
+		req.Messages = trimMessages(req.Messages, MAX_MESSAGES)
+		log.Printf("Trimmed %s request from %d to %d messages (MAX_MESSAGES=%d)", req.Model, before, len(req.Messages), MAX_MESSAGES)
+	}
+	if images := countImages(req.Messages); MAX_IMAGES_PER_REQUEST > 0 && images > MAX_IMAGES_PER_REQUEST {
+		log.Printf("Rejecting %s request with %d images (MAX_IMAGES_PER_REQUEST=%d)", req.Model, images, MAX_IMAGES_PER_REQUEST)
+		writeInvalidParam(w, "messages", fmt.Sprintf("Too many images: %d, the maximum is %d per request", images, MAX_IMAGES_PER_REQUEST))
+		return
+	}
+	if msg := applyImagePolicy(req); msg != "" {
+		writeInvalidParam(w, "messages", msg)
+		return
+	}
+	// Routing is done; authorize the model that will actually serve this.
+	if msg := modelDenied(req, req.Model); msg != "" {
+		writeError(w, http.StatusForbidden, msg, "invalid_request_error", "model_not_allowed")
+		return
+	}
+	info := modelInfo(req.Model)
+	for _, modality := range req.Modalities {
+		if !info.supportsModality(modality) {
+			writeInvalidParam(w, "modalities", fmt.Sprintf("Model %s does not support the %q output modality (supported: %s)", req.Model, modality, strings.Join(info.Modalities, ", ")))
+			return
+		}
+	}
+	applySystemPrompt(req)
+	if CONTEXT_LENGTH_CHECK && info.ContextWindow > 0 {
+		requested := modelTokenizer(req.Model).promptTokens(req.Messages)
+		if req.MaxTokens != nil {
+			requested += *req.MaxTokens
+		}
+		if requested > info.ContextWindow {
+			writeParamError(w, "messages", "context_length_exceeded", fmt.Sprintf("This model's maximum context length is %d tokens. However, your request is estimated at %d tokens (messages plus max_tokens). Please reduce the length of the messages or max_tokens.", info.ContextWindow, requested))
+			return
+		}
+	}
+	if req.BestOf > 0 && req.BestOf < req.N {
+		writeError(w, http.StatusBadRequest, "best_of must be greater than or equal to n", "invalid_request_error", "")
+		return
+	}
+	if req.bestOf() > MAX_BEST_OF {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("best_of and n may not exceed %d", MAX_BEST_OF), "invalid_request_error", "")
 		return
 	}
+	if len(REDACT_PATTERNS) > 0 {
+		if n := redactMessages(req.Messages); n > 0 {
+			log.Printf("Redacted %d matches from %s request", n, req.Model)
+		}
+	}
+	if MODERATION_URL != "" {
+		ok, reason, err := moderate(r.Context(), req)
+		if err != nil && req.deadlineExceeded() {
+			writeDeadlineExceeded(w)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, "Content moderation is unavailable, please retry later", "server_error", "moderation_unavailable")
+			return
+		}
+		if !ok {
+			msg := "Your request was rejected by content moderation"
+			if reason != "" {
+				msg += ": " + reason
+			}
+			writeError(w, http.StatusBadRequest, msg, "invalid_request_error", "content_filter")
+			return
+		}
+	}
+	if budgetsEnabled() && !checkBudget(w, apiKey) {
+		return
+	}
+	incCounter("z2api_requests_total", "model", req.Model, "key", keyLabel(apiKey))
+	req.span.set("gen_ai.request.model", req.Model)
 
-	// Get upstream model ID
-	upstreamModelID, ok := MODEL_MAP[req.Model]
+	// Wait for a concurrency slot, by priority and taking turns with other keys
+	priority, ok := requestPriority(r.Header.Get("X-Priority"), apiKey)
 	if !ok {
-		http.Error(w, "Unsupported model", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "X-Priority must be one of "+strings.Join(priorityClasses, ", "), "invalid_request_error", "invalid_priority")
+		return
+	}
+	release, err := scheduler.acquire(r.Context(), apiKey, priority)
+	if err != nil {
+		if req.deadlineExceeded() {
+			writeDeadlineExceeded(w)
+		}
+		return
+	}
+	release = sync.OnceFunc(release) // handleBestOf may hand the slot back early
+	defer release()
+	req.timings.admitted = time.Now()
+
+	authToken, err := acquireAuthToken(req.Model)
+	var blocked *anonBlockedError
+	if errors.As(err, &blocked) {
+		writeError(w, http.StatusForbidden, "Model "+req.Model+" is not available without an authenticated upstream token; the proxy has no UPSTREAM_TOKEN configured", "invalid_request_error", "model_requires_auth")
+		return
+	}
+	if err != nil {
+		log.Printf("No upstream token available: %v", err)
+		writeError(w, http.StatusServiceUnavailable, "upstream authentication unavailable", "upstream_error", "upstream_auth_unavailable")
+		return
+	}
+
+	stream, source := resolveStream(req)
+	debugLog("Model %s stream=%v (from %s)", req.Model, stream, source)
+	buffered := false
+	if stream && !modelInfo(req.Model).canStream() {
+		switch {
+		case source != "request":
+			debugLog("Model %s cannot stream, ignoring the %s default", req.Model, source)
+			stream = false
+		case STREAM_UNSUPPORTED_MODE == "error":
+			log.Printf("Rejecting stream request for %s, which cannot stream (STREAM_UNSUPPORTED_MODE=error)", req.Model)
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Model %s does not support streaming; send the request with stream set to false", req.Model), "invalid_request_error", "stream_unsupported")
+			return
+		default:
+			log.Printf("Model %s cannot stream, buffering the completion before sending it (STREAM_UNSUPPORTED_MODE=buffer)", req.Model)
+			buffered = true
+		}
+	}
+	if req.bestOf() > 1 {
+		if stream {
+			writeError(w, http.StatusBadRequest, "best_of and n greater than 1 are not supported with stream", "invalid_request_error", "")
+			return
+		}
+		handleBestOf(w, req, authToken, priority, release)
+		return
+	}
+	if stream && SSE_RESUME && !req.webSocket {
+		// The generation has to outlive the connection, for the client to
+		// resume it from; only the deadline still applies.
+		ctx := context.WithoutCancel(req.ctx)
+		if deadline, ok := req.ctx.Deadline(); ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, deadline)
+			defer cancel()
+		}
+		req.ctx = ctx
+	}
+
+	upstreamResp, _, err := openUpstreamWithFallback(req, authToken)
+	if err != nil {
+		var statusErr *upstreamStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusUnauthorized {
+			anonTokens.invalidate(authToken)
+		}
+		if req.deadlineExceeded() {
+			writeDeadlineExceeded(w)
+			return
+		}
+		writeUpstreamError(w, err)
 		return
 	}
+	defer upstreamResp.Body.Close()
+	req.timings.upstream = time.Now()
+	req.upstreamChatID = upstreamResp.Header.Get(upstreamChatIDHeader)
+	w.Header().Set(upstreamChatIDHeader, req.upstreamChatID)
+	if UPSTREAM_MODEL_HEADER {
+		w.Header().Set(upstreamModelHeader, upstreamResp.Header.Get(upstreamModelHeader))
+	}
+
+	if buffered {
+		// Read everything first, so a failure is still an HTTP error.
+		data, err := io.ReadAll(upstreamResp.Body)
+		if err != nil && req.deadlineExceeded() {
+			writeDeadlineExceeded(w)
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadGateway, fmt.Sprintf("Upstream error: %v", err), "upstream_error", "")
+			return
+		}
+		handleStreamResponse(w, bytes.NewReader(data), req)
+	} else if stream && (STREAM_IDLE_TIMEOUT > 0 || MAX_STREAM_DURATION > 0) {
+		body := newStreamGuard(upstreamResp.Body, STREAM_IDLE_TIMEOUT, MAX_STREAM_DURATION)
+		defer body.Close()
+		handleStreamResponse(w, body, req)
+		if body.expired.Load() {
+			log.Printf("Stream for %s cut off after MAX_STREAM_DURATION=%s", req.Model, MAX_STREAM_DURATION)
+			incCounter("z2api_stream_duration_exceeded_total", "model", req.Model)
+		}
+	} else if stream {
+		handleStreamResponse(w, upstreamResp.Body, req)
+	} else {
+		handleNonStreamResponse(w, upstreamResp.Body, req)
+	}
+}
 
-	// Get auth token
-	authToken := UPSTREAM_TOKEN
-	if ANON_TOKEN_ENABLED {
-		if t, err := getAnonymousToken(); err == nil {
-			authToken = t
+// trimMessages keeps the system messages and the most recent others, up to
+// limit in total. A tool result whose call was trimmed away is dropped too.
+func trimMessages(messages []Message, limit int) []Message {
+	system := 0
+	for _, m := range messages {
+		if m.Role == "system" {
+			system++
+		}
+	}
+	keep := make([]bool, len(messages))
+	for i, budget := len(messages)-1, limit-system; i >= 0; i-- {
+		if messages[i].Role == "system" {
+			keep[i] = true
+		} else if budget > 0 {
+			keep[i] = true
+			budget--
 		}
 	}
+	var trimmed []Message
+	orphan := true
+	for i, m := range messages {
+		if !keep[i] {
+			orphan = true
+			continue
+		}
+		if m.Role == "tool" && orphan {
+			continue
+		}
+		if m.Role != "system" {
+			orphan = false
+		}
+		trimmed = append(trimmed, m)
+	}
+	return trimmed
+}
 
-	// Build upstream request
-	chatID := fmt.Sprintf("%d-%d", time.Now().UnixNano(), time.Now().Unix())
-	upstreamReq := UpstreamRequest{
-		Stream:   true,
-		Model:    upstreamModelID,
-		Messages: req.Messages,
-		Params:   map[string]interface{}{},
-		Features: map[string]interface{}{"enable_thinking": true},
-		ChatID:   chatID,
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// validateSampling checks sampling parameters against the configured ranges
+// and returns the offending field and a message, or "" if all are valid.
+func validateSampling(req *OpenAIRequest) (string, string) {
+	inRange := func(v *float64, r [2]float64) bool { return v == nil || (*v >= r[0] && *v <= r[1]) }
+	if !inRange(req.Temperature, TEMPERATURE_RANGE) {
+		return "temperature", fmt.Sprintf("temperature must be between %g and %g, got %g", TEMPERATURE_RANGE[0], TEMPERATURE_RANGE[1], *req.Temperature)
+	}
+	if !inRange(req.TopP, TOP_P_RANGE) {
+		return "top_p", fmt.Sprintf("top_p must be between %g and %g, got %g", TOP_P_RANGE[0], TOP_P_RANGE[1], *req.TopP)
+	}
+	penalty := [2]float64{-2, 2}
+	if !inRange(req.FrequencyPenalty, penalty) {
+		return "frequency_penalty", fmt.Sprintf("frequency_penalty must be between -2 and 2, got %g", *req.FrequencyPenalty)
+	}
+	if !inRange(req.PresencePenalty, penalty) {
+		return "presence_penalty", fmt.Sprintf("presence_penalty must be between -2 and 2, got %g", *req.PresencePenalty)
+	}
+	if req.MaxTokens != nil && *req.MaxTokens < 1 {
+		return "max_tokens", fmt.Sprintf("max_tokens must be a positive integer, got %d", *req.MaxTokens)
+	}
+	return "", ""
+}
+
+// resolveStream decides whether to stream: an explicit request value wins,
+// then the model's MODEL_STREAM default, then DEFAULT_STREAM. It also
+// returns which of those decided, for the debug log.
+func resolveStream(req *OpenAIRequest) (bool, string) {
+	if req.Stream != nil {
+		return *req.Stream, "request"
+	}
+	if v, ok := MODEL_STREAM[req.Model]; ok {
+		return v, "MODEL_STREAM"
+	}
+	return DEFAULT_STREAM, "DEFAULT_STREAM"
+}
+
+func newUpstreamChatID() string {
+	return fmt.Sprintf("%d-%d", time.Now().UnixNano(), time.Now().Unix())
+}
+
+// buildUpstreamRequest maps an OpenAI request onto the z.ai chat format.
+func buildUpstreamRequest(req *OpenAIRequest, upstreamModelID string) UpstreamRequest {
+	chatID := newUpstreamChatID()
+	if req.conversationID != "" {
+		chatID = conversations.chatID(req.apiKey, req.conversationID)
+	}
+	return UpstreamRequest{
+		Stream:            true,
+		Model:             upstreamModelID,
+		Messages:          req.Messages,
+		Params:            upstreamParams(req),
+		Features:          upstreamFeatures(req),
+		Tools:             upstreamTools(req),
+		ToolChoice:        req.ToolChoice,
+		ParallelToolCalls: req.ParallelToolCalls,
+		ChatID:            chatID,
 		ModelItem: struct {
 			ID      string `json:"id"`
 			Name    string `json:"name"`
 			OwnedBy string `json:"owned_by"`
-		}{ID: upstreamModelID, Name: req.Model, OwnedBy: "openai"},
+		}{ID: upstreamModelID, Name: req.Model, OwnedBy: modelOwner(req.Model)},
+		extraBody: upstreamExtraBody(req),
+		clientIP:  req.clientIP,
+		ctx:       req.ctx,
+	}
+}
+
+// upstreamFeatures returns the z.ai features map for req: UPSTREAM_FEATURES,
+// then web search (the upstream feature key "web_search") if requested, then
+// the request's own features.
+func upstreamFeatures(req *OpenAIRequest) map[string]interface{} {
+	features := make(map[string]interface{}, len(UPSTREAM_FEATURES)+len(req.Features)+1)
+	for name, value := range UPSTREAM_FEATURES {
+		features[name] = value
+	}
+	if req.WebSearch {
+		features["web_search"] = true
+	}
+	for name, value := range req.Features {
+		features[name] = value
 	}
+	return features
+}
+
+// upstreamParams carries the sampling and other optional parameters the
+// client set that the upstream can take.
+func upstreamParams(req *OpenAIRequest) map[string]interface{} {
+	params := map[string]interface{}{}
+	switch {
+	case req.Temperature == nil:
+	case *req.Temperature == 0 && TEMPERATURE_ZERO_EPSILON == "omit":
+		debugLog("Omitting temperature 0 for the upstream")
+	case *req.Temperature == 0 && TEMPERATURE_ZERO_EPSILON != "":
+		epsilon, _ := strconv.ParseFloat(TEMPERATURE_ZERO_EPSILON, 64)
+		params["temperature"] = epsilon
+	default:
+		params["temperature"] = *req.Temperature
+	}
+	if req.TopP != nil {
+		params["top_p"] = *req.TopP
+	}
+	if req.FrequencyPenalty != nil {
+		params["frequency_penalty"] = *req.FrequencyPenalty
+	}
+	if req.PresencePenalty != nil {
+		params["presence_penalty"] = *req.PresencePenalty
+	}
+	if req.MaxTokens != nil {
+		params["max_tokens"] = *req.MaxTokens
+	}
+	if len(req.Prediction) > 0 {
+		if modelInfo(req.Model).hasCapability("prediction") {
+			params["prediction"] = req.Prediction
+		} else {
+			debugLog("Dropping prediction: model %s does not support predicted outputs", req.Model)
+		}
+	}
+	if req.Logprobs {
+		params["logprobs"] = true
+		if req.TopLogprobs != nil {
+			params["top_logprobs"] = *req.TopLogprobs
+		}
+	}
+	return params
+}
+
+// upstreamTools returns the request's tools, wrapping legacy functions as
+// function tools so the upstream only has to understand one form.
+func upstreamTools(req *OpenAIRequest) []json.RawMessage {
+	if len(req.Tools) > 0 || len(req.Functions) == 0 {
+		return req.Tools
+	}
+	tools := make([]json.RawMessage, 0, len(req.Functions))
+	for _, fn := range req.Functions {
+		tool, err := json.Marshal(map[string]json.RawMessage{"type": json.RawMessage(`"function"`), "function": fn})
+		if err == nil {
+			tools = append(tools, tool)
+		}
+	}
+	return tools
+}
 
-	// Make the request
-	upstreamResp, err := callUpstream(upstreamReq, chatID, authToken)
+// upstreamStatusError is a non-200 reply from the upstream.
+type upstreamStatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *upstreamStatusError) Error() string {
+	return fmt.Sprintf("Upstream error: %s", e.Body)
+}
+
+// openUpstream sends req to the upstream and returns the response once it is
+// known to be a successful stream. The caller closes the body. When the
+// upstream rejects our frontend version, it refreshes the version and retries
+// once.
+func openUpstream(req *OpenAIRequest, upstreamModelID, authToken string) (*http.Response, error) {
+	sent := feVersion.current()
+	resp, err := openUpstreamOnce(req, upstreamModelID, authToken)
+	var statusErr *upstreamStatusError
+	if !errors.As(err, &statusErr) || !isNewVersionError(statusErr) {
+		return resp, err
+	}
+	version, refreshErr := feVersion.refresh(sent)
+	if refreshErr == nil {
+		incCounter("z2api_fe_version_rejections_total", "retried", "true")
+		log.Printf("Upstream rejected X-FE-Version %s, retrying with %s", sent, version)
+		resp, err = openUpstreamOnce(req, upstreamModelID, authToken)
+		if !errors.As(err, &statusErr) || !isNewVersionError(statusErr) {
+			return resp, err
+		}
+		refreshErr = fmt.Errorf("version %s was rejected too", version)
+	} else {
+		incCounter("z2api_fe_version_rejections_total", "retried", "false")
+	}
+	log.Printf("Upstream rejected X-FE-Version %s and auto-refresh failed (%v); set X_FE_VERSION to the current chat.z.ai version", feVersion.current(), refreshErr)
+	return nil, &upstreamStatusError{
+		StatusCode: statusErr.StatusCode,
+		Body:       fmt.Sprintf("upstream rejected frontend version %s; the operator needs to update X_FE_VERSION", feVersion.current()),
+	}
+}
+
+func openUpstreamOnce(req *OpenAIRequest, upstreamModelID, authToken string) (*http.Response, error) {
+	upstreamReq := buildUpstreamRequest(req, upstreamModelID)
+	upstreamSpan := req.span.child("upstream "+upstreamModelID, spanKindClient)
+	defer upstreamSpan.end()
+	upstreamSpan.set("gen_ai.request.model", upstreamModelID)
+	resp, err := callUpstream(upstreamReq, upstreamReq.ChatID, authToken, req.requestID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadGateway)
+		upstreamSpan.fail(err)
+		return nil, err
+	}
+	upstreamSpan.set("http.response.status_code", resp.StatusCode)
+	upstreamTokens.report(authToken, resp.StatusCode)
+	// The transport only decompresses transparently when it negotiated the
+	// encoding itself; handle upstreams that compress unasked.
+	if !resp.Uncompressed && strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to decompress upstream response: %v", err)
+		}
+		resp.Body = gzipReadCloser{gz, resp.Body}
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		debugLog("Upstream error status=%d request_id=%s body=%s", resp.StatusCode, req.requestID, body)
+		if DEBUG_MODE {
+			debugLog("Rejected upstream request (Authorization: Bearer %s): %s", redactToken(authToken), loggableUpstreamRequest(upstreamReq))
+		}
+		statusErr := &upstreamStatusError{StatusCode: resp.StatusCode, Body: string(body)}
+		upstreamSpan.fail(statusErr)
+		return nil, statusErr
+	}
+	// The z.ai chat_id is generated here; record it with the response so
+	// callers can report it for correlation with upstream logs.
+	resp.Header.Set(upstreamChatIDHeader, upstreamReq.ChatID)
+	resp.Header.Set(upstreamModelHeader, upstreamModelID)
+	return resp, nil
+}
+
+// upstreamChatIDHeader carries the upstream chat_id, both on the upstream
+// response (set by openUpstream) and on ours. upstreamModelHeader does the
+// same for the upstream model id, which after a fallback is not
+// MODEL_MAP[req.Model].
+const (
+	upstreamChatIDHeader = "X-Upstream-Chat-ID"
+	upstreamModelHeader  = "X-Upstream-Model"
+)
+
+// loggableUpstreamRequest renders the upstream body for the debug log with
+// every message truncated to LOG_CONTENT_MAX characters.
+func loggableUpstreamRequest(upstreamReq UpstreamRequest) string {
+	messages := make([]Message, len(upstreamReq.Messages))
+	for i, m := range upstreamReq.Messages {
+		m.Content = truncateForLog(m.Content)
+		if len(m.Parts) > 0 {
+			parts := make([]ContentPart, len(m.Parts))
+			for j, p := range m.Parts {
+				p.Text = truncateForLog(p.Text)
+				if p.ImageURL != nil {
+					image := *p.ImageURL
+					image.URL = truncateForLog(image.URL)
+					p.ImageURL = &image
+				}
+				parts[j] = p
+			}
+			m.Parts = parts
+		}
+		messages[i] = m
+	}
+	upstreamReq.Messages = messages
+	body, err := json.Marshal(upstreamReq)
+	if err != nil {
+		return fmt.Sprintf("<unmarshalable: %v>", err)
+	}
+	return string(body)
+}
+
+func truncateForLog(s string) string {
+	if LOG_CONTENT_MAX > 0 && utf8.RuneCountInString(s) > LOG_CONTENT_MAX {
+		return string([]rune(s)[:LOG_CONTENT_MAX]) + "…(truncated)"
+	}
+	return s
+}
+
+// redactToken keeps just enough of a token to tell tokens apart in logs.
+func redactToken(token string) string {
+	if len(token) <= 8 {
+		return "<redacted>"
+	}
+	return token[:4] + "…<redacted>"
+}
+
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (g gzipReadCloser) Close() error {
+	g.Reader.Close()
+	return g.body.Close()
+}
+
+func writeUpstreamError(w http.ResponseWriter, err error) {
+	var throttled *modelThrottledError
+	if errors.As(err, &throttled) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(throttled.wait.Seconds()))))
+		writeError(w, http.StatusTooManyRequests, throttled.Error(), "rate_limit_error", "rate_limit_exceeded")
 		return
 	}
-	defer upstreamResp.Body.Close()
+	var statusErr *upstreamStatusError
+	if errors.As(err, &statusErr) {
+		writeError(w, clientStatus(statusErr.StatusCode), statusErr.Error(), "upstream_error", "")
+		return
+	}
+	writeError(w, clientStatus(http.StatusBadGateway), err.Error(), "upstream_error", "")
+}
 
-	// Proxy the response
-	for h, val := range upstreamResp.Header {
-		w.Header()[h] = val
+// clientStatus applies STATUS_CODE_MAP to an upstream failure's status.
+func clientStatus(status int) int {
+	if mapped, ok := STATUS_CODE_MAP[status]; ok {
+		debugLog("Reporting upstream status %d as %d (STATUS_CODE_MAP)", status, mapped)
+		return mapped
 	}
-	w.WriteHeader(upstreamResp.StatusCode)
-	io.Copy(w, upstreamResp.Body)
+	return status
+}
+
+// deadlineExceeded reports whether r ran out of its REQUEST_DEADLINE.
+func (r *OpenAIRequest) deadlineExceeded() bool {
+	return r.ctx != nil && errors.Is(r.ctx.Err(), context.DeadlineExceeded)
 }
 
-func callUpstream(upstreamReq UpstreamRequest, refererChatID string, authToken string) (*http.Response, error) {
+func writeDeadlineExceeded(w http.ResponseWriter) {
+	writeError(w, http.StatusGatewayTimeout, fmt.Sprintf("Request did not complete within REQUEST_DEADLINE (%s)", REQUEST_DEADLINE), "upstream_error", "request_deadline_exceeded")
+}
+
+// upstreamURLPlaceholders are substituted into UPSTREAM_URL per request.
+var upstreamURLPlaceholders = []string{"{model}", "{chat_id}"}
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// upstreamURL expands the UPSTREAM_URL template for upstreamReq; a URL
+// without placeholders is used as-is.
+func upstreamURL(upstreamReq UpstreamRequest) string {
+	if !strings.Contains(UPSTREAM_URL, "{") {
+		return UPSTREAM_URL
+	}
+	return strings.NewReplacer(
+		"{model}", url.PathEscape(upstreamReq.Model),
+		"{chat_id}", url.PathEscape(upstreamReq.ChatID),
+	).Replace(UPSTREAM_URL)
+}
+
+// validateUpstreamURL rejects unknown placeholders and templates that do not
+// expand to an absolute URL.
+func validateUpstreamURL() error {
+	for _, p := range placeholderPattern.FindAllString(UPSTREAM_URL, -1) {
+		if !contains(upstreamURLPlaceholders, p) {
+			return fmt.Errorf("UPSTREAM_URL has unknown placeholder %s (supported: %s)", p, strings.Join(upstreamURLPlaceholders, ", "))
+		}
+	}
+	u, err := url.Parse(upstreamURL(UpstreamRequest{Model: "model", ChatID: "chat"}))
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("UPSTREAM_URL %q is not an absolute URL", UPSTREAM_URL)
+	}
+	return nil
+}
+
+func callUpstream(upstreamReq UpstreamRequest, refererChatID string, authToken string, requestID string) (*http.Response, error) {
 	reqBody, err := json.Marshal(upstreamReq)
+	if err == nil && len(upstreamReq.extraBody) > 0 {
+		reqBody, err = mergeJSON(reqBody, upstreamReq.extraBody)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal upstream request: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", UPSTREAM_URL, bytes.NewBuffer(reqBody))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create upstream request: %v", err)
+	ctx := upstreamReq.ctx
+	if ctx == nil {
+		ctx = context.Background()
 	}
+	send := func(body []byte, gzipped bool) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", upstreamURL(upstreamReq), bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create upstream request: %v", err)
+		}
 
-	req.Header.Set("Authorization", "Bearer "+authToken)
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "text/event-stream")
-	req.Header.Set("User-Agent", BROWSER_UA)
-	req.Header.Set("Origin", ORIGIN_BASE)
-	req.Header.Set("Referer", ORIGIN_BASE+"/c/"+refererChatID)
-	req.Header.Set("X-FE-Version", X_FE_VERSION)
-	req.Header.Set("sec-ch-ua", SEC_CH_UA)
-	req.Header.Set("sec-ch-ua-mobile", SEC_CH_UA_MOB)
-	req.Header.Set("sec-ch-ua-platform", SEC_CH_UA_PLAT)
-	req.Header.Set("Accept-Language", "zh-CN")
-
-	client := &http.Client{Timeout: 60 * time.Second}
-	return client.Do(req)
+		req.Header.Set("Authorization", "Bearer "+authToken)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("User-Agent", BROWSER_UA)
+		req.Header.Set("Origin", ORIGIN_BASE)
+		req.Header.Set("Referer", ORIGIN_BASE+"/c/"+refererChatID)
+		req.Header.Set("X-FE-Version", feVersion.current())
+		req.Header.Set("sec-ch-ua", SEC_CH_UA)
+		req.Header.Set("sec-ch-ua-mobile", SEC_CH_UA_MOB)
+		req.Header.Set("sec-ch-ua-platform", SEC_CH_UA_PLAT)
+		req.Header.Set("Accept-Language", "zh-CN")
+		if UPSTREAM_REQUEST_ID_HEADER != "off" && requestID != "" {
+			req.Header.Set(UPSTREAM_REQUEST_ID_HEADER, requestID)
+		}
+		if FORWARD_CLIENT_IP != "" && upstreamReq.clientIP != "" {
+			req.Header.Set(FORWARD_CLIENT_IP, upstreamReq.clientIP)
+		}
+		if gzipped {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+
+		client := &http.Client{Timeout: 60 * time.Second, Transport: upstreamTransport}
+		return client.Do(req)
+	}
+
+	if !UPSTREAM_GZIP || upstreamGzipRejected.Load() || len(reqBody) < UPSTREAM_GZIP_MIN_BYTES {
+		return send(reqBody, false)
+	}
+	resp, err := send(gzipBody(reqBody), true)
+	if err != nil || (resp.StatusCode != http.StatusUnsupportedMediaType && resp.StatusCode != http.StatusBadRequest) {
+		return resp, err
+	}
+	// The upstream may not understand compressed bodies; try again without.
+	resp.Body.Close()
+	status := resp.StatusCode
+	resp, err = send(reqBody, false)
+	if err == nil && resp.StatusCode == http.StatusOK {
+		upstreamGzipRejected.Store(true)
+		log.Printf("Upstream rejected a gzip request body with status %d; sending request bodies uncompressed from now on", status)
+	}
+	return resp, err
 }
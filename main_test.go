@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the tests against the default configuration, as initConfig
+// builds it from an empty environment.
+func TestMain(m *testing.M) {
+	initConfig()
+	os.Exit(m.Run())
+}
+
+// setConfig changes a setting for the rest of the test.
+func setConfig[T any](t *testing.T, setting *T, value T) {
+	t.Helper()
+	old := *setting
+	*setting = value
+	t.Cleanup(func() { *setting = old })
+}
+
+func TestValidateSampling(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+	n := func(v int) *int { return &v }
+	tests := []struct {
+		name      string
+		req       OpenAIRequest
+		wantParam string
+	}{
+		{"unset", OpenAIRequest{}, ""},
+		{"temperature 0", OpenAIRequest{Temperature: f(0)}, ""},
+		{"temperature 2", OpenAIRequest{Temperature: f(2)}, ""},
+		{"temperature below 0", OpenAIRequest{Temperature: f(-0.01)}, "temperature"},
+		{"temperature above 2", OpenAIRequest{Temperature: f(2.01)}, "temperature"},
+		{"top_p 0", OpenAIRequest{TopP: f(0)}, ""},
+		{"top_p 1", OpenAIRequest{TopP: f(1)}, ""},
+		{"top_p below 0", OpenAIRequest{TopP: f(-0.01)}, "top_p"},
+		{"top_p above 1", OpenAIRequest{TopP: f(1.01)}, "top_p"},
+		{"frequency_penalty -2", OpenAIRequest{FrequencyPenalty: f(-2)}, ""},
+		{"frequency_penalty above 2", OpenAIRequest{FrequencyPenalty: f(2.5)}, "frequency_penalty"},
+		{"presence_penalty 2", OpenAIRequest{PresencePenalty: f(2)}, ""},
+		{"presence_penalty below -2", OpenAIRequest{PresencePenalty: f(-2.5)}, "presence_penalty"},
+		{"max_tokens 1", OpenAIRequest{MaxTokens: n(1)}, ""},
+		{"max_tokens 0", OpenAIRequest{MaxTokens: n(0)}, "max_tokens"},
+		{"max_tokens negative", OpenAIRequest{MaxTokens: n(-1)}, "max_tokens"},
+		{"first offending field", OpenAIRequest{Temperature: f(5), TopP: f(2)}, "temperature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			param, msg := validateSampling(&tt.req)
+			if param != tt.wantParam {
+				t.Errorf("validateSampling = %q (%s), want %q", param, msg, tt.wantParam)
+			}
+			if param != "" && !strings.Contains(msg, param) {
+				t.Errorf("message %q does not name %s", msg, param)
+			}
+		})
+	}
+}
+
+func TestValidateSamplingConfiguredRanges(t *testing.T) {
+	setConfig(t, &TEMPERATURE_RANGE, [2]float64{0, 5})
+	setConfig(t, &TOP_P_RANGE, [2]float64{0.1, 1})
+	f := func(v float64) *float64 { return &v }
+	tests := []struct {
+		name      string
+		req       OpenAIRequest
+		wantParam string
+	}{
+		{"temperature 5", OpenAIRequest{Temperature: f(5)}, ""},
+		{"temperature above 5", OpenAIRequest{Temperature: f(5.01)}, "temperature"},
+		{"top_p 0.1", OpenAIRequest{TopP: f(0.1)}, ""},
+		{"top_p 0", OpenAIRequest{TopP: f(0)}, "top_p"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if param, msg := validateSampling(&tt.req); param != tt.wantParam {
+				t.Errorf("validateSampling = %q (%s), want %q", param, msg, tt.wantParam)
+			}
+		})
+	}
+}
+
+func TestCompleteChatRejectsSampling(t *testing.T) {
+	temperature := 5.0
+	req := &OpenAIRequest{Model: "GLM-4.5", Messages: []Message{{Role: "user", Content: "hi"}}, Temperature: &temperature}
+	w := httptest.NewRecorder()
+	completeChat(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil), "sk-test", req)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want 400: %s", w.Code, w.Body)
+	}
+	var resp ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("body is not an error envelope: %s", w.Body)
+	}
+	if resp.Error.Type != "invalid_request_error" || resp.Error.Param == nil || *resp.Error.Param != "temperature" {
+		t.Errorf("error = %+v, want an invalid_request_error for temperature", resp.Error)
+	}
+	if !strings.Contains(resp.Error.Message, "between 0 and 2") {
+		t.Errorf("message %q does not give the valid range", resp.Error.Message)
+	}
+}
+
+func TestParsePairs(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		want     map[string]string
+		warnings int
+	}{
+		{"simple", "GLM-4.5:0727-360B-API,GLM-4.5V:glm-4.5v", map[string]string{"GLM-4.5": "0727-360B-API", "GLM-4.5V": "glm-4.5v"}, 0},
+		{"spaces", " a : x , b:y ", map[string]string{"a": "x", "b": "y"}, 0},
+		{"colons in value", "a:http://host:8080/model", map[string]string{"a": "http://host:8080/model"}, 0},
+		{"escaped comma in value", `a:x\,y,b:z`, map[string]string{"a": "x,y", "b": "z"}, 0},
+		{"escaped colon in name", `ns\:model:upstream`, map[string]string{"ns:model": "upstream"}, 0},
+		{"escaped backslash", `a:x\\,b:y`, map[string]string{"a": `x\`, "b": "y"}, 0},
+		{"escaped backslash before colon", `a\\:x`, map[string]string{`a\`: "x"}, 0},
+		{"escaped comma in name", `a\,b:x`, map[string]string{"a,b": "x"}, 0},
+		{"trailing backslash", `a:x\`, map[string]string{"a": `x\`}, 0},
+		{"empty entries skipped", ",a:x,,", map[string]string{"a": "x"}, 0},
+		{"empty input", "", map[string]string{}, 0},
+		{"no colon", "a:x,bogus", map[string]string{"a": "x"}, 1},
+		{"escaped colon only", `a\:x`, map[string]string{}, 1},
+		{"empty value", "a:,b:y", map[string]string{"b": "y"}, 1},
+		{"empty name", ":x", map[string]string{}, 1},
+		{"duplicate, last wins", "a:x,a:y", map[string]string{"a": "y"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logged strings.Builder
+			log.SetOutput(&logged)
+			defer log.SetOutput(os.Stderr)
+			got := parsePairs("MODEL_MAP", tt.in)
+			if !maps.Equal(got, tt.want) {
+				t.Errorf("parsePairs(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if n := strings.Count(logged.String(), "Warning: "); n != tt.warnings {
+				t.Errorf("logged %d warnings, want %d:\n%s", n, tt.warnings, logged.String())
+			}
+		})
+	}
+}
+
+func TestParsePairsKeepsValuesOutOfLog(t *testing.T) {
+	var logged strings.Builder
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	parsePairs("HMAC_KEYS", "client:s3cret-one,client:s3cret-two,other:")
+	if strings.Contains(logged.String(), "s3cret") {
+		t.Errorf("log contains a value:\n%s", logged.String())
+	}
+}
+
+func TestDebugEcho(t *testing.T) {
+	setConfig(t, &DEBUG_MODE, true)
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	r.Header.Set("X-Debug-Echo", "true")
+	secrets := map[string]string{
+		"Authorization":    "Bearer sk-secret",
+		"X-Api-Key":        "sk-secret",
+		"Api-Key":          "sk-secret",
+		"X-Upstream-Token": "secret-token",
+		"X-Gateway-Auth":   "secret",
+		"Cookie":           "session=secret",
+	}
+	for name, value := range secrets {
+		r.Header.Set(name, value)
+	}
+	r.Header.Set("X-Long", strings.Repeat("a", 1000))
+	w := httptest.NewRecorder()
+	setDebugEcho(w, r, &OpenAIRequest{Model: "GLM-4.5"})
+
+	var echo debugEcho
+	if err := json.Unmarshal([]byte(w.Header().Get("X-Debug-Echo")), &echo); err != nil {
+		t.Fatalf("X-Debug-Echo is not JSON: %v", err)
+	}
+	for name := range secrets {
+		if echo.Headers[name] != "[redacted]" {
+			t.Errorf("%s echoed as %q", name, echo.Headers[name])
+		}
+	}
+	if long := echo.Headers["X-Long"]; len(long) > echoValueMax+20 || !strings.HasSuffix(long, "[truncated]") {
+		t.Errorf("long value echoed as %d bytes: %q", len(long), long)
+	}
+
+	for i := 0; i < 100; i++ {
+		r.Header.Set(fmt.Sprintf("X-Filler-%03d", i), strings.Repeat("b", 200))
+	}
+	w = httptest.NewRecorder()
+	setDebugEcho(w, r, &OpenAIRequest{Model: "GLM-4.5"})
+	value := w.Header().Get("X-Debug-Echo")
+	if len(value) > echoMaxBytes {
+		t.Errorf("X-Debug-Echo is %d bytes, over %d", len(value), echoMaxBytes)
+	}
+	if err := json.Unmarshal([]byte(value), &echo); err != nil || !echo.Truncated {
+		t.Errorf("oversized echo is not marked truncated: %v", err)
+	}
+}
+
+func TestCacheIdentityIncludesJWTScopes(t *testing.T) {
+	if cacheIdentity("sk-test", []string{"model:a"}) != "sk-test" {
+		t.Errorf("scopes change the identity outside jwt mode")
+	}
+	setConfig(t, &AUTH_MODE, "jwt")
+	narrow := cacheIdentity("jwt:alice", []string{"model:a"})
+	wide := cacheIdentity("jwt:alice", []string{"model:b", "model:a"})
+	if narrow == wide {
+		t.Errorf("tokens with different scopes share identity %q", narrow)
+	}
+	if wide != cacheIdentity("jwt:alice", []string{"model:a", "model:b"}) {
+		t.Errorf("identity depends on the order of the scopes")
+	}
+}
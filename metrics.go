@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A minimal Prometheus text-format registry; the proxy has no external
+// dependencies, so counters and gauges are kept by hand.
+type metricFamily struct {
+	help   string
+	kind   string // "counter" or "gauge"
+	values map[string]float64
+	gauge  func() map[string]float64
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   = map[string]*metricFamily{}
+)
+
+func registerCounter(name, help string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics[name] = &metricFamily{help: help, kind: "counter", values: map[string]float64{}}
+}
+
+// registerGauge registers a gauge whose labelled values are computed on
+// scrape. fn returns label sets (as rendered by labels()) mapped to values.
+func registerGauge(name, help string, fn func() map[string]float64) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics[name] = &metricFamily{help: help, kind: "gauge", gauge: fn}
+}
+
+// incCounter adds one to the counter series identified by label pairs.
+func incCounter(name string, labelPairs ...string) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if m, ok := metrics[name]; ok && m.values != nil {
+		m.values[labels(labelPairs...)]++
+	}
+}
+
+// labels renders key/value pairs as a Prometheus label set.
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// keyLabel identifies an API key in metrics without exposing it.
+func keyLabel(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:4])
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	families := make([]*metricFamily, len(names))
+	for i, name := range names {
+		families[i] = metrics[name]
+	}
+	snapshots := make([]map[string]float64, len(names))
+	for i, m := range families {
+		if m.values != nil {
+			snapshots[i] = make(map[string]float64, len(m.values))
+			for k, v := range m.values {
+				snapshots[i][k] = v
+			}
+		}
+	}
+	metricsMu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for i, name := range names {
+		m := families[i]
+		values := snapshots[i]
+		if m.gauge != nil {
+			values = m.gauge()
+		}
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, m.help, name, m.kind)
+		series := make([]string, 0, len(values))
+		for s := range values {
+			series = append(series, s)
+		}
+		sort.Strings(series)
+		for _, s := range series {
+			fmt.Fprintf(w, "%s%s %g\n", name, s, values[s])
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+// ModelInfo describes what a model can do. Built-in entries are keyed by
+// upstream model ID; MODEL_METADATA overrides them by client-facing name.
+type ModelInfo struct {
+	// Capabilities lists input features, e.g. "text", "vision".
+	Capabilities []string `json:"capabilities,omitempty"`
+	// Modalities lists the output modalities the model can produce.
+	Modalities    []string `json:"modalities,omitempty"`
+	ContextWindow int      `json:"context_window,omitempty"`
+	// Streaming is false for models that cannot stream; see
+	// STREAM_UNSUPPORTED_MODE. Unset means they can.
+	Streaming *bool `json:"streaming,omitempty"`
+}
+
+var builtinModelInfo = map[string]ModelInfo{
+	"0727-360B-API": {Capabilities: []string{"text"}, Modalities: []string{"text"}, ContextWindow: 128000},
+	"glm-4.5v":      {Capabilities: []string{"text", "vision"}, Modalities: []string{"text"}, ContextWindow: 64000},
+}
+
+var defaultModelInfo = ModelInfo{Capabilities: []string{"text"}, Modalities: []string{"text"}}
+
+// modelInfo returns the metadata for a client-facing model name.
+func modelInfo(name string) ModelInfo {
+	info, ok := MODEL_METADATA[name]
+	if !ok {
+		if info, ok = builtinModelInfo[MODEL_MAP[name]]; !ok {
+			return defaultModelInfo
+		}
+	}
+	if len(info.Capabilities) == 0 {
+		info.Capabilities = defaultModelInfo.Capabilities
+	}
+	if len(info.Modalities) == 0 {
+		info.Modalities = defaultModelInfo.Modalities
+	}
+	return info
+}
+
+func (m ModelInfo) hasCapability(capability string) bool {
+	return contains(m.Capabilities, capability)
+}
+
+func (m ModelInfo) canStream() bool {
+	return m.Streaming == nil || *m.Streaming
+}
+
+func (m ModelInfo) supportsModality(modality string) bool {
+	return contains(m.Modalities, modality)
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ModelParams are per-model defaults from MODEL_PARAMS, used for the
+// parameters a request leaves unset.
+type ModelParams struct {
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"`
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`
+}
+
+// applyModelParams fills in the model's defaults; client values win.
+func applyModelParams(req *OpenAIRequest) {
+	params, ok := MODEL_PARAMS[req.Model]
+	if !ok {
+		return
+	}
+	if req.FrequencyPenalty == nil {
+		req.FrequencyPenalty = params.FrequencyPenalty
+	}
+	if req.PresencePenalty == nil {
+		req.PresencePenalty = params.PresencePenalty
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// moderationRequest is what MODERATION_URL receives: the model and the
+// text of each message, after REDACT_PATTERNS.
+type moderationRequest struct {
+	Model    string              `json:"model"`
+	Messages []moderationMessage `json:"messages"`
+}
+
+type moderationMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// moderationVerdict is the MODERATION_URL reply; reason is shown to the
+// client when the request is denied.
+type moderationVerdict struct {
+	Allowed *bool  `json:"allowed"`
+	Reason  string `json:"reason"`
+}
+
+// moderate asks MODERATION_URL whether req may proceed, returning ok when
+// it may and otherwise the denial reason. A moderation service that fails or
+// replies nonsense lets the request through, unless MODERATION_FAIL_MODE is
+// closed, in which case the failure is returned.
+func moderate(ctx context.Context, req *OpenAIRequest) (ok bool, reason string, err error) {
+	verdict, err := callModeration(ctx, req)
+	if err != nil {
+		incCounter("z2api_moderation_total", "result", "error")
+		if MODERATION_FAIL_MODE == "closed" {
+			log.Printf("Moderation failed, rejecting request: %v", err)
+			return false, "", err
+		}
+		log.Printf("Moderation failed, allowing request: %v", err)
+		return true, "", nil
+	}
+	if !*verdict.Allowed {
+		incCounter("z2api_moderation_total", "result", "deny")
+		log.Printf("Moderation denied %s request: %s", req.Model, verdict.Reason)
+		return false, verdict.Reason, nil
+	}
+	incCounter("z2api_moderation_total", "result", "allow")
+	return true, "", nil
+}
+
+func callModeration(ctx context.Context, req *OpenAIRequest) (*moderationVerdict, error) {
+	body := moderationRequest{Model: req.Model, Messages: []moderationMessage{}}
+	for _, m := range req.Messages {
+		body.Messages = append(body.Messages, moderationMessage{Role: m.Role, Content: m.Content})
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, MODERATION_TIMEOUT)
+	defer cancel()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, MODERATION_URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("moderation service returned status %d", resp.StatusCode)
+	}
+	var verdict moderationVerdict
+	if err := json.NewDecoder(resp.Body).Decode(&verdict); err != nil || verdict.Allowed == nil {
+		return nil, fmt.Errorf("moderation service reply has no \"allowed\" field")
+	}
+	return &verdict, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// upstreamHealth is the result of the latest UPSTREAM_PING_INTERVAL probe.
+type upstreamHealth struct {
+	mu       sync.Mutex
+	checked  time.Time
+	latency  time.Duration
+	err      error
+	failures int
+}
+
+var upstreamPing upstreamHealth
+
+// pingUpstream probes UPSTREAM_PING_URL every UPSTREAM_PING_INTERVAL, which
+// also keeps pooled connections to the upstream host warm.
+func pingUpstream() {
+	client := &http.Client{Timeout: 10 * time.Second, Transport: upstreamTransport}
+	for !serverDraining.Load() {
+		start := time.Now()
+		err := probeUpstream(client)
+		upstreamPing.record(start, time.Since(start), err)
+		time.Sleep(UPSTREAM_PING_INTERVAL)
+	}
+}
+
+// probeUpstream counts any answer below 500 as healthy: the endpoint may
+// well refuse an unauthenticated probe.
+func probeUpstream(client *http.Client) error {
+	req, err := http.NewRequest("GET", UPSTREAM_PING_URL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", BROWSER_UA)
+	req.Header.Set("Origin", ORIGIN_BASE)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("ping status=%d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (h *upstreamHealth) record(at time.Time, latency time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case err != nil && h.failures == 0:
+		log.Printf("Upstream ping failed: %v", err)
+	case err == nil && h.failures > 0:
+		log.Printf("Upstream ping recovered after %d failures", h.failures)
+	}
+	h.checked, h.latency, h.err = at, latency, err
+	if err != nil {
+		h.failures++
+	} else {
+		h.failures = 0
+	}
+}
+
+// status summarizes the last probe for /health.
+func (h *upstreamHealth) status() map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checked.IsZero() {
+		return map[string]interface{}{"status": "unknown"}
+	}
+	status := map[string]interface{}{
+		"status":     "ok",
+		"checked_at": h.checked.UTC().Format(time.RFC3339),
+		"latency_ms": h.latency.Milliseconds(),
+	}
+	if h.err != nil {
+		status["status"] = "degraded"
+		status["error"] = h.err.Error()
+		status["consecutive_failures"] = h.failures
+	}
+	return status
+}
+
+func (h *upstreamHealth) up() map[string]float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.checked.IsZero() {
+		return nil
+	}
+	if h.err != nil {
+		return map[string]float64{"": 0}
+	}
+	return map[string]float64{"": 1}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// runPlugin pipes data through PLUGIN_CMD (run with sh -c) and returns its
+// stdout. PLUGIN_STAGE tells the command whether data is the OpenAI
+// "request" or the non-streaming "response". An exit status other than 0,
+// or no output, fails the request.
+func runPlugin(ctx context.Context, stage string, data []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, PLUGIN_TIMEOUT)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", PLUGIN_CMD)
+	cmd.Env = append(os.Environ(), "PLUGIN_STAGE="+stage)
+	cmd.Stdin = bytes.NewReader(data)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("plugin %s hook failed: %v: %s", stage, err, strings.TrimSpace(stderr.String()))
+	}
+	out := bytes.TrimSpace(stdout.Bytes())
+	if len(out) == 0 {
+		return nil, fmt.Errorf("plugin %s hook produced no output", stage)
+	}
+	return out, nil
+}
+
+// pluginRewriteRequest lets PLUGIN_CMD rewrite req. Fields not part of the
+// JSON request survive the round trip.
+func pluginRewriteRequest(ctx context.Context, req *OpenAIRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	out, err := runPlugin(ctx, "request", data)
+	if err != nil {
+		return err
+	}
+	rewritten := OpenAIRequest{
+		streamProgress: req.streamProgress,
+		apiKey:         req.apiKey,
+		requestID:      req.requestID,
+		clientIP:       req.clientIP,
+		omitFields:     req.omitFields,
+		span:           req.span,
+		webSocket:      req.webSocket,
+	}
+	if err := json.Unmarshal(out, &rewritten); err != nil {
+		return fmt.Errorf("plugin request hook returned invalid JSON: %v", err)
+	}
+	*req = rewritten
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows rate requests per minute, with bursts of up to a
+// minute's worth.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(perMinute int) *tokenBucket {
+	burst := float64(perMinute)
+	return &tokenBucket{rate: burst / 60, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take consumes one token if available; otherwise it reports how long until
+// one will be.
+func (b *tokenBucket) take() (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// modelLimiters holds one bucket per model in MODEL_RATE_LIMITS, built in
+// initConfig.
+var modelLimiters = map[string]*tokenBucket{}
+
+// allowModel reports whether a request for model fits its MODEL_RATE_LIMITS
+// entry, and if not, how long the client should wait.
+func allowModel(model string) (bool, time.Duration) {
+	bucket, ok := modelLimiters[model]
+	if !ok {
+		return true, 0
+	}
+	return bucket.take()
+}
+
+// modelThrottledError is a model that was not tried because it is over its
+// MODEL_RATE_LIMITS entry.
+type modelThrottledError struct {
+	model string
+	wait  time.Duration
+}
+
+func (e *modelThrottledError) Error() string {
+	return fmt.Sprintf("Rate limit reached for model %s: %d requests per minute", e.model, MODEL_RATE_LIMITS[e.model])
+}
@@ -0,0 +1,31 @@
+package main
+
+// redactMessages replaces REDACT_PATTERNS matches in the text of messages
+// with REDACT_PLACEHOLDER and returns the number of replacements.
+func redactMessages(messages []Message) int {
+	count := 0
+	for i := range messages {
+		m := &messages[i]
+		if len(m.Parts) == 0 {
+			m.Content = redactText(m.Content, &count)
+			continue
+		}
+		for j := range m.Parts {
+			if m.Parts[j].Type == "text" {
+				m.Parts[j].Text = redactText(m.Parts[j].Text, &count)
+			}
+		}
+		m.Content = partsText(m.Parts)
+	}
+	return count
+}
+
+func redactText(s string, count *int) string {
+	for _, re := range REDACT_PATTERNS {
+		s = re.ReplaceAllStringFunc(s, func(string) string {
+			*count++
+			return REDACT_PLACEHOLDER
+		})
+	}
+	return s
+}
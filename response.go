@@ -0,0 +1,927 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// UpstreamData is one `data:` event of the z.ai SSE stream.
+type UpstreamData struct {
+	Type string `json:"type"`
+	Data struct {
+		DeltaContent upstreamText   `json:"delta_content"`
+		EditContent  string         `json:"edit_content"`
+		Phase        string         `json:"phase"`
+		Done         bool           `json:"done"`
+		Usage        *Usage         `json:"usage,omitempty"`
+		ToolCalls    []ToolCall     `json:"tool_calls,omitempty"`
+		FinishReason string         `json:"finish_reason,omitempty"`
+		Logprobs     *Logprobs      `json:"logprobs,omitempty"`
+		Error        *UpstreamError `json:"error,omitempty"`
+		// ContentParts carries multimodal output, in the OpenAI parts shape.
+		ContentParts []ContentPart `json:"content_parts,omitempty"`
+	} `json:"data"`
+	Error *UpstreamError `json:"error,omitempty"`
+}
+
+type UpstreamError struct {
+	Detail string `json:"detail"`
+	Code   int    `json:"code"`
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("upstream error %d: %s", e.Code, e.Detail)
+}
+
+// upstreamResult is what remains of an upstream stream once its content has
+// been handed to the caller.
+type upstreamResult struct {
+	FinishReason string
+	Usage        *Usage
+	ToolCalls    []ToolCall
+	FunctionCall *FunctionCall // legacy shape, replaces ToolCalls
+	Logprobs     *Logprobs     // only when requested and sent by the upstream
+	Annotations  []Annotation  // url_citation for each appended reference
+	Parts        []ContentPart // non-text output such as images, after the text
+	// EstimatedOutput counts the emitted content with the model's tokenizer, for
+	// when the upstream reports no usage.
+	EstimatedOutput int
+}
+
+// readUpstreamEvents decodes the upstream SSE stream, calling fn for every
+// well-formed event until fn asks to stop or the stream ends. Lines are read
+// with bufio.Reader so a single oversized event does not hit a scanner limit.
+//
+// A data payload that does not parse is held back and joined with the lines
+// that follow, since the upstream occasionally splits one JSON object over
+// several lines. It is only skipped as malformed once the event ends (blank
+// line or EOF) or it outgrows EVENT_REASSEMBLY_MAX_BYTES.
+func readUpstreamEvents(body io.Reader, fn func(*UpstreamData) (stop bool, err error)) error {
+	reader := bufio.NewReader(body)
+	var pending string
+	var pendingErr error
+	dropPending := func() {
+		if pending != "" {
+			debugLog("Skipping malformed upstream event (%d bytes): %v", len(pending), pendingErr)
+			pending = ""
+		}
+	}
+	for {
+		line, readErr := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		var payload string
+		isData := strings.HasPrefix(line, "data:")
+		switch {
+		case isData:
+			payload = strings.TrimSpace(strings.TrimPrefix(line, "data:"))
+		case pending != "" && line != "" && !strings.HasPrefix(line, ":"):
+			payload = line // continuation of a payload broken by a raw newline
+		case line == "":
+			dropPending()
+		}
+		if payload == "[DONE]" && pending == "" {
+			return nil
+		}
+		if payload != "" {
+			candidate := pending + payload
+			var ev UpstreamData
+			err := json.Unmarshal([]byte(candidate), &ev)
+			if err != nil && pending != "" && isData {
+				// The new line may be a complete event of its own.
+				var alone UpstreamData
+				if json.Unmarshal([]byte(payload), &alone) == nil {
+					dropPending()
+					candidate, ev, err = payload, alone, nil
+				}
+			}
+			switch {
+			case err == nil:
+				pending = ""
+				stop, err := fn(&ev)
+				if err != nil || stop {
+					return err
+				}
+			default:
+				pending, pendingErr = candidate, err
+				if EVENT_REASSEMBLY_MAX_BYTES <= 0 || len(pending) > EVENT_REASSEMBLY_MAX_BYTES {
+					dropPending()
+				}
+			}
+		}
+		if readErr == io.EOF {
+			dropPending()
+			return nil
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+}
+
+var (
+	reasoningOpenTag = regexp.MustCompile(`<details[^>]*>\n?`)
+	reasoningSummary = regexp.MustCompile(`(?s)<summary>.*?</summary>`)
+)
+
+// translator turns upstream events into client-visible content deltas,
+// applying THINK_TAGS_MODE to the reasoning phase.
+type translator struct {
+	thinkMode       string
+	inThinking      bool
+	thinkingBudget  float64 // tokens of reasoning left under MAX_THINKING_TOKENS
+	thinkingCut     bool
+	parallelTools   bool
+	legacyFunctions bool
+	upstreamFinish  string
+	answerStarted   bool
+	truncated       bool         // output hit MAX_OUTPUT_TOKENS_CAP
+	keepPartial     bool         // finish a timed-out stream, for RETURN_PARTIAL_ON_TIMEOUT
+	timedOut        bool         // the upstream timed out and keepPartial applied
+	lastDelta       upstreamText // previous non-empty delta, for DEDUPE_DELTAS
+	lastPhase       string
+	text            utf8Carry
+	topLogprobs     int            // -1 when logprobs were not requested
+	logprobs        []TokenLogprob // all tokens so far
+	unsent          int            // logprobs not yet attached to a chunk
+	outputTokens    float64        // estimated with tokenizer
+	tokenizer       tokenizer
+	webSearch       bool
+	searchBuf       string          // tool_call content not yet parsed
+	citations       []Citation      // search results, appended as references
+	emittedRunes    int             // content so far, for annotation offsets
+	trailing        string          // whitespace held back by TRIM_TRAILING
+	toolNames       map[string]bool // declared tools, nil unless TOOL_CALL_DETECTION applies
+	toolScan        string          // answer text held back by scanToolCalls
+	inlineCalls     []ToolCall      // tool calls found in the answer text
+	emit            func(content string) error
+}
+
+func newTranslator(req *OpenAIRequest, emit func(content string) error) *translator {
+	thinkMode := req.thinkMode
+	if thinkMode == "" {
+		// Requests that did not come through completeChat, like /admin/test.
+		thinkMode = THINK_TAGS_MODE
+	}
+	t := &translator{
+		thinkMode:       thinkMode,
+		parallelTools:   req.allowsParallelToolCalls() && !req.usesLegacyFunctions(),
+		legacyFunctions: req.usesLegacyFunctions(),
+		topLogprobs:     requestedTopLogprobs(req),
+		webSearch:       req.WebSearch,
+		tokenizer:       modelTokenizer(req.Model),
+		thinkingBudget:  float64(MAX_THINKING_TOKENS),
+	}
+	t.emit = func(content string) error {
+		t.outputTokens += t.tokenizer.cost(content)
+		t.emittedRunes += utf8.RuneCountInString(content)
+		return emit(content)
+	}
+	if TOOL_CALL_DETECTION && len(upstreamTools(req)) > 0 {
+		t.toolNames = declaredToolNames(req)
+	}
+	if MAX_OUTPUT_TOKENS_CAP > 0 {
+		t.emit = t.capOutput(t.emit, MAX_OUTPUT_TOKENS_CAP)
+	}
+	if TRIM_TRAILING {
+		t.emit = t.holdTrailing(t.emit)
+	}
+	return t
+}
+
+// holdTrailing implements TRIM_TRAILING: whitespace at the end of each
+// piece of content is held back until more text follows it, so whitespace
+// the content ends with is never sent, nor is a chunk with nothing else.
+func (t *translator) holdTrailing(emit func(content string) error) func(content string) error {
+	return func(content string) error {
+		content = t.trailing + content
+		text := strings.TrimRightFunc(content, unicode.IsSpace)
+		t.trailing = content[len(text):]
+		if text == "" {
+			return nil
+		}
+		return emit(text)
+	}
+}
+
+// capOutput is the MAX_OUTPUT_TOKENS_CAP backstop for upstreams that ignore
+// max_tokens: once the (estimated) output reaches limit the content is cut
+// there and the translator stops reading with finish_reason "length".
+func (t *translator) capOutput(emit func(content string) error, limit int) func(content string) error {
+	budget := float64(limit)
+	return func(content string) error {
+		if t.truncated {
+			return nil
+		}
+		var cut bool
+		content, budget, cut = t.tokenizer.truncate(content, budget)
+		if cut {
+			debugLog("Output reached MAX_OUTPUT_TOKENS_CAP=%d, truncating", limit)
+			t.truncated = true
+		}
+		if content == "" {
+			return nil
+		}
+		return emit(content)
+	}
+}
+
+func requestedTopLogprobs(req *OpenAIRequest) int {
+	switch {
+	case !req.Logprobs:
+		return -1
+	case req.TopLogprobs != nil:
+		return *req.TopLogprobs
+	}
+	return 0
+}
+
+// takeLogprobs returns the logprobs received since the last call, for the
+// next stream chunk.
+func (t *translator) takeLogprobs() *Logprobs {
+	if t.unsent == len(t.logprobs) {
+		return nil
+	}
+	lp := &Logprobs{Content: t.logprobs[t.unsent:]}
+	t.unsent = len(t.logprobs)
+	return lp
+}
+
+// run consumes the upstream body and returns how the completion ended.
+func (t *translator) run(body io.Reader) (*upstreamResult, error) {
+	result := &upstreamResult{FinishReason: "stop"}
+	err := readUpstreamEvents(body, func(ev *UpstreamData) (bool, error) {
+		if e := ev.Error; e != nil || ev.Data.Error != nil {
+			if e == nil {
+				e = ev.Data.Error
+			}
+			return true, e
+		}
+		if ev.Data.Usage != nil {
+			result.Usage = ev.Data.Usage
+		}
+		result.ToolCalls = t.addToolCalls(result.ToolCalls, ev.Data.ToolCalls)
+		for _, part := range ev.Data.ContentParts {
+			if part.Type == "text" {
+				ev.Data.DeltaContent += upstreamText(part.Text)
+			} else {
+				result.Parts = append(result.Parts, part)
+			}
+		}
+		if ev.Data.FinishReason != "" {
+			t.upstreamFinish = ev.Data.FinishReason
+		}
+		if lp := ev.Data.Logprobs; lp != nil && t.topLogprobs >= 0 {
+			t.logprobs = append(t.logprobs, trimTopLogprobs(lp.Content, t.topLogprobs)...)
+		}
+		if DEDUPE_DELTAS && t.isRepeat(ev) {
+			debugLog("Skipping repeated upstream delta %q", ev.Data.DeltaContent)
+			ev.Data.DeltaContent = ""
+		}
+		ev.Data.DeltaContent = upstreamText(t.text.push(string(ev.Data.DeltaContent)))
+		if err := t.handle(ev); err != nil {
+			return true, err
+		}
+		return ev.Data.Done || t.truncated, nil
+	})
+	if errors.Is(err, errStreamExpired) {
+		// Cut off like an output cap, ending with finish_reason "length".
+		t.truncated, err = true, nil
+	}
+	if err != nil && t.keepPartial && isTimeout(err) && t.emittedRunes > 0 {
+		log.Printf("Upstream timed out after %d characters of content, returning them truncated with finish_reason %q", t.emittedRunes, RETURN_PARTIAL_ON_TIMEOUT)
+		t.timedOut, err = true, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n := t.text.pending(); n > 0 {
+		debugLog("Dropping %d bytes of an incomplete UTF-8 sequence at the end of the stream", n)
+	}
+	if t.inThinking {
+		if err := t.closeThinking(); err != nil {
+			return nil, err
+		}
+	}
+	if t.toolScan != "" {
+		// A fence that never closed is just text.
+		if err := t.emit(t.toolScan); err != nil {
+			return nil, err
+		}
+		t.toolScan = ""
+	}
+	result.ToolCalls = t.addToolCalls(result.ToolCalls, t.inlineCalls)
+	if t.trailing != "" {
+		debugLog("Trimmed %d bytes of trailing whitespace", len(t.trailing))
+		t.trailing = ""
+	}
+	if len(t.citations) > 0 && !t.truncated {
+		references, annotations := citationReferences(t.citations, t.emittedRunes)
+		if err := t.emit(references); err != nil {
+			return nil, err
+		}
+		// The output cap may have cut the references short; annotate only
+		// the ones that made it out.
+		for _, a := range annotations {
+			if a.URLCitation.EndIndex <= t.emittedRunes {
+				result.Annotations = append(result.Annotations, a)
+			}
+		}
+	}
+	if t.legacyFunctions && len(result.ToolCalls) > 0 {
+		fn := result.ToolCalls[0].Function
+		result.FunctionCall, result.ToolCalls = &fn, nil
+	}
+	if t.topLogprobs >= 0 {
+		if len(t.logprobs) > 0 {
+			result.Logprobs = &Logprobs{Content: t.logprobs}
+		} else {
+			debugLog("logprobs were requested but the upstream sent none")
+		}
+	}
+	result.FinishReason = t.finishReason(result)
+	result.EstimatedOutput = int(math.Ceil(t.outputTokens))
+	return result, nil
+}
+
+// finishReason maps the upstream's reason onto the OpenAI values, taking
+// precedence for tool and function calls since clients key off those to run
+// the calls.
+func (t *translator) finishReason(result *upstreamResult) string {
+	switch {
+	case result.FunctionCall != nil:
+		return "function_call"
+	case len(result.ToolCalls) > 0:
+		return "tool_calls"
+	}
+	if t.timedOut {
+		return RETURN_PARTIAL_ON_TIMEOUT
+	}
+	if t.truncated {
+		return "length"
+	}
+	switch t.upstreamFinish {
+	case "length", "max_tokens":
+		return "length"
+	case "content_filter", "sensitive":
+		return "content_filter"
+	}
+	return "stop"
+}
+
+// isRepeat reports whether ev repeats the previous event's content exactly,
+// a known upstream quirk.
+func (t *translator) isRepeat(ev *UpstreamData) bool {
+	if ev.Data.DeltaContent == "" {
+		return false
+	}
+	repeat := ev.Data.DeltaContent == t.lastDelta && ev.Data.Phase == t.lastPhase
+	t.lastDelta, t.lastPhase = ev.Data.DeltaContent, ev.Data.Phase
+	return repeat
+}
+
+func (t *translator) handle(ev *UpstreamData) error {
+	if t.webSearch && ev.Data.Phase == "tool_call" {
+		// Search activity, not answer text.
+		t.collectCitations(ev)
+		return nil
+	}
+	switch ev.Data.Phase {
+	case "thinking":
+		if t.thinkMode == "raw" {
+			return t.emitNonEmpty(string(ev.Data.DeltaContent))
+		}
+		if !t.inThinking {
+			t.inThinking = true
+			if t.thinkMode == "think" {
+				if err := t.emit("<think>"); err != nil {
+					return err
+				}
+			}
+		}
+		if t.thinkMode == "strip" {
+			return nil
+		}
+		return t.emitThinking(cleanThinking(string(ev.Data.DeltaContent)))
+	default:
+		if t.inThinking {
+			if err := t.closeThinking(); err != nil {
+				return err
+			}
+		}
+		content := string(ev.Data.DeltaContent)
+		// The first answer event may carry the closing reasoning block in
+		// edit_content; only the part after it belongs to the answer.
+		if content == "" && ev.Data.EditContent != "" {
+			if t.thinkMode == "raw" {
+				content = ev.Data.EditContent
+			} else if _, after, ok := strings.Cut(ev.Data.EditContent, "</details>"); ok {
+				content = strings.TrimPrefix(after, "\n")
+			}
+		}
+		if !t.answerStarted && OUTPUT_TRIM_LEADING != nil {
+			// Keep trimming until something is left: the unwanted prefix may
+			// arrive as several deltas.
+			content = OUTPUT_TRIM_LEADING.ReplaceAllString(content, "")
+		}
+		if content != "" {
+			t.answerStarted = true
+		}
+		return t.emitAnswer(content)
+	}
+}
+
+// addToolCalls collects tool calls returned by the upstream. With
+// parallel_tool_calls disabled only the first call is kept, whether or not
+// the upstream honored the flag.
+func (t *translator) addToolCalls(calls, more []ToolCall) []ToolCall {
+	for _, call := range more {
+		if !t.parallelTools && len(calls) > 0 {
+			debugLog("Dropping tool call %q: parallel_tool_calls is false", call.Function.Name)
+			continue
+		}
+		i := len(calls)
+		call.Index = &i
+		if call.Type == "" {
+			call.Type = "function"
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+// thinkingEllipsis marks reasoning cut short by MAX_THINKING_TOKENS.
+const thinkingEllipsis = "…"
+
+// emitThinking emits reasoning until MAX_THINKING_TOKENS is used up, then
+// an ellipsis, and drops the rest of the reasoning.
+func (t *translator) emitThinking(content string) error {
+	if MAX_THINKING_TOKENS <= 0 {
+		return t.emitNonEmpty(content)
+	}
+	if t.thinkingCut {
+		return nil
+	}
+	var cut bool
+	content, t.thinkingBudget, cut = t.tokenizer.truncate(content, t.thinkingBudget)
+	if cut {
+		log.Printf("Reasoning reached MAX_THINKING_TOKENS=%d, truncating it", MAX_THINKING_TOKENS)
+		t.thinkingCut = true
+		content += thinkingEllipsis
+	}
+	return t.emitNonEmpty(content)
+}
+
+func (t *translator) closeThinking() error {
+	t.inThinking = false
+	if t.thinkMode == "think" {
+		return t.emit("</think>\n")
+	}
+	return nil
+}
+
+func (t *translator) emitNonEmpty(content string) error {
+	if content == "" {
+		return nil
+	}
+	return t.emit(content)
+}
+
+// cleanThinking removes the z.ai reasoning markup from a thinking delta.
+func cleanThinking(s string) string {
+	s = reasoningSummary.ReplaceAllString(s, "")
+	s = reasoningOpenTag.ReplaceAllString(s, "")
+	s = strings.ReplaceAll(s, "</details>", "")
+	s = strings.TrimPrefix(s, "> ")
+	return strings.ReplaceAll(s, "\n> ", "\n")
+}
+
+var codeFencePattern = regexp.MustCompile("(?s)^\\s*```[\\w.+-]*[ \\t]*\\r?\\n(.*?)\\r?\\n?[ \\t]*```\\s*$")
+
+// stripCodeFences unwraps content that is exactly one fenced code block,
+// optionally with a language hint, and returns anything else unchanged.
+func stripCodeFences(s string) string {
+	m := codeFencePattern.FindStringSubmatch(s)
+	if m == nil || strings.Contains(m[1], "```") {
+		return s
+	}
+	return m[1]
+}
+
+func newCompletionID() string {
+	return fmt.Sprintf("chatcmpl-%d", time.Now().UnixNano())
+}
+
+// handleStreamResponse translates the upstream stream into OpenAI chunks.
+func handleStreamResponse(w http.ResponseWriter, body io.Reader, req *OpenAIRequest) {
+	setSSEHeaders(w)
+	id := newCompletionID()
+	sse := newSSEWriter(w)
+	progress := startProgress(sse, req)
+	defer progress.stop()
+	if SSE_RESUME && !req.webSocket {
+		// The id is what a reconnect asks for, so it must not be guessable.
+		id = "chatcmpl-" + newRequestID()
+		streamWithReplay(sse, body, req, id, progress.stop)
+		return
+	}
+	streamChunks(body, req, id, func(payload []byte) error {
+		return sse.event("", payload)
+	}, progress.stop)
+}
+
+// errStreamIdle ends a stream whose upstream went STREAM_IDLE_TIMEOUT without
+// sending anything, and errStreamExpired one that ran past
+// MAX_STREAM_DURATION.
+var (
+	errStreamIdle    = errors.New("upstream sent no data within STREAM_IDLE_TIMEOUT")
+	errStreamExpired = errors.New("stream exceeded MAX_STREAM_DURATION")
+)
+
+// streamGuard closes an upstream body that goes quiet for longer than
+// idleTimeout or is still running after maxDuration, which cancels the
+// upstream request and unblocks the pending Read; zero disables either
+// limit. Only received bytes reset the idle timer, our own outbound
+// keepalive comments do not.
+type streamGuard struct {
+	body        io.ReadCloser
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+	deadline    *time.Timer
+	idle        atomic.Bool
+	expired     atomic.Bool
+}
+
+func newStreamGuard(body io.ReadCloser, idleTimeout, maxDuration time.Duration) *streamGuard {
+	g := &streamGuard{body: body, idleTimeout: idleTimeout}
+	if idleTimeout > 0 {
+		g.idleTimer = time.AfterFunc(idleTimeout, func() {
+			g.idle.Store(true)
+			body.Close()
+		})
+	}
+	if maxDuration > 0 {
+		g.deadline = time.AfterFunc(maxDuration, func() {
+			g.expired.Store(true)
+			body.Close()
+		})
+	}
+	return g
+}
+
+func (g *streamGuard) Read(p []byte) (int, error) {
+	n, err := g.body.Read(p)
+	switch {
+	case g.expired.Load():
+		return 0, errStreamExpired
+	case g.idle.Load():
+		return 0, errStreamIdle
+	}
+	if n > 0 && g.idleTimer != nil {
+		g.idleTimer.Reset(g.idleTimeout)
+	}
+	return n, err
+}
+
+func (g *streamGuard) Close() error {
+	for _, timer := range []*time.Timer{g.idleTimer, g.deadline} {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	return g.body.Close()
+}
+
+// streamChunks runs the translator and passes every rendered chunk, followed
+// by the terminating [DONE], to send. onContent, if set, is called before
+// the first content delta.
+func streamChunks(body io.Reader, req *OpenAIRequest, id string, send func(payload []byte) error, onContent func()) {
+	created := time.Now().Unix()
+	fingerprint := systemFingerprint(req.Model)
+	var t *translator
+	writeChunk := func(delta *Delta, finishReason string, usage *Usage) error {
+		chunk := OpenAIResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   req.Model,
+			Choices: []Choice{{Index: 0, Delta: delta, FinishReason: finishReason}},
+			Usage:   usage,
+
+			SystemFingerprint: fingerprint,
+		}
+		if UPSTREAM_CHAT_ID_FIELD {
+			chunk.UpstreamChatID = req.upstreamChatID
+		}
+		if t != nil {
+			chunk.Choices[0].Logprobs = t.takeLogprobs()
+		}
+		data, err := json.Marshal(chunk)
+		if err != nil {
+			return err
+		}
+		return send(omitFields(data, req.omitFields))
+	}
+
+	// Like OpenAI, open with exactly one role-only chunk so SDKs can set up
+	// the message before any content arrives.
+	empty := ""
+	if err := writeChunk(&Delta{Role: "assistant", Content: &empty}, "", nil); err != nil {
+		return
+	}
+	// With continuous_usage_stats every content chunk carries running
+	// (estimated) usage; otherwise usage only appears on the final chunk.
+	var running *Usage
+	if req.StreamOptions != nil && req.StreamOptions.ContinuousUsageStats {
+		prompt := modelTokenizer(req.Model).promptTokens(req.Messages)
+		running = &Usage{PromptTokens: prompt, TotalTokens: prompt}
+	}
+	t = newTranslator(req, func(content string) error {
+		if onContent != nil {
+			onContent()
+			onContent = nil
+		}
+		if req.timings.firstToken.IsZero() {
+			req.timings.firstToken = time.Now()
+		}
+		for _, piece := range splitUTF8(content, CHUNK_SIZE) {
+			var usage *Usage
+			if running != nil {
+				running.CompletionTokens += modelTokenizer(req.Model).count(piece)
+				running.TotalTokens = running.PromptTokens + running.CompletionTokens
+				snapshot := *running
+				usage = &snapshot
+			}
+			if err := writeChunk(&Delta{Content: &piece}, "", usage); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	result, err := t.run(body)
+	if err != nil {
+		// The 200 status is already out; tell the client in-band, using the
+		// error event OpenAI SDKs raise on, instead of finishing normally.
+		log.Printf("Upstream stream failed mid-stream: %v", err)
+		req.span.fail(err)
+		incCounter("z2api_stream_errors_total", "model", req.Model)
+		code := "stream_interrupted"
+		if errors.Is(err, errStreamIdle) {
+			code = "stream_idle_timeout"
+		}
+		data, _ := json.Marshal(ErrorResponse{Error: ErrorDetail{
+			Message: fmt.Sprintf("Upstream stream failed: %v", err),
+			Type:    "upstream_error",
+			Code:    stringPtr(code),
+		}})
+		if send(data) == nil {
+			send([]byte("[DONE]"))
+		}
+		return
+	}
+	if len(result.ToolCalls) > 0 || result.FunctionCall != nil {
+		if err := writeChunk(&Delta{ToolCalls: result.ToolCalls, FunctionCall: result.FunctionCall}, "", nil); err != nil {
+			return
+		}
+	}
+	if len(result.Annotations) > 0 {
+		if err := writeChunk(&Delta{Annotations: result.Annotations}, "", nil); err != nil {
+			return
+		}
+	}
+	if len(result.Parts) > 0 {
+		if err := writeChunk(&Delta{Parts: result.Parts}, "", nil); err != nil {
+			return
+		}
+	}
+	usage := result.Usage
+	if usage == nil && running != nil {
+		usage = running
+	}
+	req.recordUsage(usage, result)
+	if err := writeChunk(&Delta{}, result.FinishReason, usage); err != nil {
+		return
+	}
+	send([]byte("[DONE]"))
+}
+
+// splitUTF8 cuts s into pieces of at most size bytes without splitting a
+// multibyte rune, so an upstream that sends one enormous delta still reaches
+// the client incrementally. size <= 0 disables splitting.
+func splitUTF8(s string, size int) []string {
+	if size <= 0 || len(s) <= size {
+		return []string{s}
+	}
+	pieces := make([]string, 0, len(s)/size+1)
+	for len(s) > size {
+		n := size
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		if n == 0 {
+			// size is smaller than this rune; emit the rune whole.
+			_, n = utf8.DecodeRuneInString(s)
+		}
+		pieces = append(pieces, s[:n])
+		s = s[n:]
+	}
+	if s != "" {
+		pieces = append(pieces, s)
+	}
+	return pieces
+}
+
+// collectCompletion reads a whole upstream stream into one string. A stream
+// that fails is an error, unless it timed out after some content arrived and
+// RETURN_PARTIAL_ON_TIMEOUT says to return that content truncated.
+func collectCompletion(body io.Reader, req *OpenAIRequest) (string, *upstreamResult, error) {
+	var content strings.Builder
+	t := newTranslator(req, func(delta string) error {
+		content.WriteString(delta)
+		return nil
+	})
+	t.keepPartial = RETURN_PARTIAL_ON_TIMEOUT != ""
+	result, err := t.run(body)
+	if err != nil {
+		return "", nil, err
+	}
+
+	text := content.String()
+	if STRIP_CODE_FENCES || req.wantsJSON() {
+		text = stripCodeFences(text)
+	}
+	return text, result, nil
+}
+
+// isTimeout reports whether err comes from a deadline, such as the upstream
+// client timeout hitting while the body is read.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// handleNonStreamResponse still reads the upstream as a stream, keeping only
+// one copy of the assembled content, and writes the final JSON without
+// re-buffering that content (see writeCompletionJSON).
+func handleNonStreamResponse(w http.ResponseWriter, body io.Reader, req *OpenAIRequest) {
+	text, result, err := collectCompletion(body, req)
+	if err != nil && req.deadlineExceeded() {
+		writeDeadlineExceeded(w)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, fmt.Sprintf("Upstream error: %v", err), "upstream_error", "")
+		return
+	}
+
+	resp := OpenAIResponse{
+		ID:      newCompletionID(),
+		Object:  "chat.completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: []Choice{{Index: 0, Message: assistantMessage(result), Logprobs: result.Logprobs, FinishReason: result.FinishReason}},
+		Usage:   result.Usage,
+
+		SystemFingerprint: systemFingerprint(req.Model),
+	}
+	if UPSTREAM_CHAT_ID_FIELD {
+		resp.UpstreamChatID = req.upstreamChatID
+	}
+	req.recordUsage(result.Usage, result)
+	writeCompletion(w, req, resp, []string{text})
+}
+
+// writeCompletion writes a non-streaming completion for req, through the
+// PLUGIN_CMD response hook when one is configured.
+func writeCompletion(w http.ResponseWriter, req *OpenAIRequest, resp OpenAIResponse, contents []string) {
+	omit := req.omitFields
+	w.Header().Set("Content-Type", "application/json")
+	if PLUGIN_CMD == "" {
+		if err := writeCompletionJSON(w, resp, contents, omit); err != nil {
+			debugLog("Writing response failed: %v", err)
+		}
+		return
+	}
+	var buf bytes.Buffer
+	if err := writeCompletionJSON(&buf, resp, contents, omit); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error(), "server_error", "")
+		return
+	}
+	ctx := req.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	out, err := runPlugin(ctx, "response", buf.Bytes())
+	if err == nil && !json.Valid(out) {
+		err = errors.New("plugin response hook returned invalid JSON")
+	}
+	if err != nil {
+		log.Printf("%v", err)
+		writeError(w, http.StatusInternalServerError, "response plugin failed", "server_error", "plugin_error")
+		return
+	}
+	w.Write(append(out, '\n'))
+}
+
+// assistantMessage builds the non-streaming message for result; its content
+// is filled in by writeCompletionJSON.
+func assistantMessage(result *upstreamResult) *Message {
+	msg := &Message{Role: "assistant", FunctionCall: result.FunctionCall, Annotations: result.Annotations, Parts: result.Parts}
+	for _, call := range result.ToolCalls {
+		call.Index = nil // streaming only
+		msg.ToolCalls = append(msg.ToolCalls, call)
+	}
+	return msg
+}
+
+// contentPlaceholder marks where choice i's content is spliced into the
+// marshaled envelope. NUL cannot appear unescaped in any other field.
+func contentPlaceholder(i int) string {
+	return fmt.Sprintf("\x00z2api-content-%d\x00", i)
+}
+
+// writeCompletionJSON marshals resp with placeholders instead of the choice
+// contents, then streams each content string into the output in escaped
+// segments. Large completions are therefore never duplicated in memory, and
+// the response goes out with chunked transfer encoding instead of a
+// precomputed Content-Length.
+func writeCompletionJSON(w io.Writer, resp OpenAIResponse, contents []string, omit []string) error {
+	for i := range resp.Choices {
+		if resp.Choices[i].Message != nil && i < len(contents) {
+			msg := *resp.Choices[i].Message
+			msg.Content = contentPlaceholder(i)
+			if len(msg.Parts) > 0 {
+				// Multimodal output: the text becomes the first part.
+				msg.Parts = append([]ContentPart{{Type: "text", Text: msg.Content}}, msg.Parts...)
+			}
+			resp.Choices[i].Message = &msg
+		}
+	}
+	envelope, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	envelope = omitFields(envelope, omit)
+	for i, content := range contents {
+		marker, _ := json.Marshal(contentPlaceholder(i))
+		before, after, ok := bytes.Cut(envelope, marker)
+		if !ok {
+			return errors.New("content placeholder missing from response envelope")
+		}
+		if _, err := w.Write(before); err != nil {
+			return err
+		}
+		if err := writeJSONString(w, content); err != nil {
+			return err
+		}
+		envelope = after
+	}
+	envelope = append(envelope, '\n')
+	_, err = w.Write(envelope)
+	return err
+}
+
+const jsonSegmentSize = 32 * 1024
+
+// writeJSONString writes s as a quoted JSON string, escaping it segment by
+// segment on rune boundaries.
+func writeJSONString(w io.Writer, s string) error {
+	if _, err := io.WriteString(w, `"`); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	for len(s) > 0 {
+		n := min(jsonSegmentSize, len(s))
+		for n < len(s) && !utf8.RuneStart(s[n]) {
+			n++
+		}
+		buf.Reset()
+		if err := enc.Encode(s[:n]); err != nil {
+			return err
+		}
+		// Drop the quotes and trailing newline added by Encode.
+		escaped := bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+		if _, err := w.Write(escaped[1 : len(escaped)-1]); err != nil {
+			return err
+		}
+		s = s[n:]
+	}
+	_, err := io.WriteString(w, `"`)
+	return err
+}
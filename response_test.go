@@ -0,0 +1,955 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+	"unicode/utf8"
+)
+
+// upstreamBody renders upstream events as the z.ai SSE stream, ending with
+// the done event.
+func upstreamBody(events ...string) string {
+	var b strings.Builder
+	for _, ev := range events {
+		b.WriteString("data: " + ev + "\n\n")
+	}
+	b.WriteString(`data: {"type":"chat:completion","data":{"phase":"done","done":true}}` + "\n\n")
+	return b.String()
+}
+
+// answerEvent is an upstream event carrying delta as answer content.
+func answerEvent(delta string) string {
+	text, _ := json.Marshal(delta)
+	return `{"type":"chat:completion","data":{"phase":"answer","delta_content":` + string(text) + `}}`
+}
+
+// streamFixture runs body through streamChunks and decodes the chunks it
+// sends, failing the test unless the stream ends with [DONE].
+func streamFixture(t *testing.T, req *OpenAIRequest, body io.Reader) []OpenAIResponse {
+	t.Helper()
+	var payloads []string
+	streamChunks(body, req, "chatcmpl-test", func(payload []byte) error {
+		payloads = append(payloads, string(payload))
+		return nil
+	}, nil)
+	if len(payloads) == 0 || payloads[len(payloads)-1] != "[DONE]" {
+		t.Fatalf("stream did not end with [DONE]: %q", payloads)
+	}
+	chunks := make([]OpenAIResponse, len(payloads)-1)
+	for i, payload := range payloads[:len(payloads)-1] {
+		if err := json.Unmarshal([]byte(payload), &chunks[i]); err != nil || len(chunks[i].Choices) != 1 {
+			t.Fatalf("payload %d is not a chunk: %s", i, payload)
+		}
+	}
+	return chunks
+}
+
+// chunkContents returns the content of each chunk that has some.
+func chunkContents(chunks []OpenAIResponse) []string {
+	var contents []string
+	for _, chunk := range chunks {
+		if delta := chunk.Choices[0].Delta; delta != nil && delta.Content != nil && *delta.Content != "" {
+			contents = append(contents, *delta.Content)
+		}
+	}
+	return contents
+}
+
+func TestStripCodeFences(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"json hint", "```json\n{\"a\":1}\n```", `{"a":1}`},
+		{"no hint", "```\n{\"a\":1}\n```", `{"a":1}`},
+		{"surrounding whitespace", "\n  ```json\n{\"a\":1}\n```  \n", `{"a":1}`},
+		{"crlf", "```json\r\n{\"a\":1}\r\n```", `{"a":1}`},
+		{"hint with symbols", "```json5 \n{a:1}\n```", "{a:1}"},
+		{"multiline body", "```json\n{\n  \"a\": 1\n}\n```", "{\n  \"a\": 1\n}"},
+		{"not fenced", `{"a":1}`, `{"a":1}`},
+		{"text before fence", "Here:\n```json\n{\"a\":1}\n```", "Here:\n```json\n{\"a\":1}\n```"},
+		{"text after fence", "```json\n{\"a\":1}\n```\nDone.", "```json\n{\"a\":1}\n```\nDone."},
+		{"two blocks", "```\na\n```\n```\nb\n```", "```\na\n```\n```\nb\n```"},
+		{"unclosed", "```json\n{\"a\":1}", "```json\n{\"a\":1}"},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripCodeFences(tt.in); got != tt.want {
+				t.Errorf("stripCodeFences(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectCompletionCodeFences(t *testing.T) {
+	fenced := upstreamBody(answerEvent("```json\n"), answerEvent(`{"a":1}`), answerEvent("\n```"))
+	plain := upstreamBody(answerEvent(`{"a":1}`))
+	jsonFormat := &ResponseFormat{Type: "json_object"}
+	tests := []struct {
+		name   string
+		strip  bool
+		format *ResponseFormat
+		body   string
+		want   string
+	}{
+		{"fenced, no option", false, nil, fenced, "```json\n{\"a\":1}\n```"},
+		{"fenced, STRIP_CODE_FENCES", true, nil, fenced, `{"a":1}`},
+		{"fenced, json response_format", false, jsonFormat, fenced, `{"a":1}`},
+		{"plain, STRIP_CODE_FENCES", true, nil, plain, `{"a":1}`},
+		{"plain, json response_format", false, jsonFormat, plain, `{"a":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &STRIP_CODE_FENCES, tt.strip)
+			req := &OpenAIRequest{Model: "GLM-4.5", ResponseFormat: tt.format}
+			got, _, err := collectCompletion(strings.NewReader(tt.body), req)
+			if err != nil {
+				t.Fatalf("collectCompletion: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFinishReason(t *testing.T) {
+	call := []ToolCall{{ID: "call_1", Type: "function", Function: FunctionCall{Name: "f", Arguments: "{}"}}}
+	tests := []struct {
+		name      string
+		result    upstreamResult
+		truncated bool
+		upstream  string
+		want      string
+	}{
+		{"plain", upstreamResult{}, false, "", "stop"},
+		{"upstream stop", upstreamResult{}, false, "stop", "stop"},
+		{"upstream length", upstreamResult{}, false, "length", "length"},
+		{"upstream max_tokens", upstreamResult{}, false, "max_tokens", "length"},
+		{"upstream content_filter", upstreamResult{}, false, "content_filter", "content_filter"},
+		{"upstream sensitive", upstreamResult{}, false, "sensitive", "content_filter"},
+		{"unknown upstream reason", upstreamResult{}, false, "something", "stop"},
+		{"output cap", upstreamResult{}, true, "", "length"},
+		{"output cap over upstream stop", upstreamResult{}, true, "stop", "length"},
+		{"tool calls", upstreamResult{ToolCalls: call}, false, "", "tool_calls"},
+		{"tool calls over length", upstreamResult{ToolCalls: call}, true, "length", "tool_calls"},
+		{"tool calls over content_filter", upstreamResult{ToolCalls: call}, false, "content_filter", "tool_calls"},
+		{"function call", upstreamResult{FunctionCall: &call[0].Function}, false, "", "function_call"},
+		{"function call over length", upstreamResult{FunctionCall: &call[0].Function}, true, "length", "function_call"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &translator{truncated: tt.truncated, upstreamFinish: tt.upstream}
+			if got := tr.finishReason(&tt.result); got != tt.want {
+				t.Errorf("finishReason = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFinishReasonForRequest(t *testing.T) {
+	tool := json.RawMessage(`{"type":"function","function":{"name":"f"}}`)
+	function := json.RawMessage(`{"name":"f"}`)
+	toolCall := `{"type":"chat:completion","data":{"phase":"answer","tool_calls":[{"id":"c1","function":{"name":"f","arguments":"{}"}}]}}`
+	tests := []struct {
+		name      string
+		legacy    bool
+		tools     []json.RawMessage
+		functions []json.RawMessage
+		events    []string
+		want      string
+	}{
+		{"no calls", true, []json.RawMessage{tool}, nil, []string{answerEvent("hi")}, "stop"},
+		{"tools", true, []json.RawMessage{tool}, nil, []string{toolCall}, "tool_calls"},
+		{"functions, LEGACY_FUNCTION_CALL", true, nil, []json.RawMessage{function}, []string{toolCall}, "function_call"},
+		{"functions, LEGACY_FUNCTION_CALL off", false, nil, []json.RawMessage{function}, []string{toolCall}, "tool_calls"},
+		{"functions and tools", true, []json.RawMessage{tool}, []json.RawMessage{function}, []string{toolCall}, "tool_calls"},
+		{"functions, no calls", true, nil, []json.RawMessage{function}, []string{answerEvent("hi")}, "stop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &LEGACY_FUNCTION_CALL, tt.legacy)
+			req := &OpenAIRequest{Model: "GLM-4.5", Tools: tt.tools, Functions: tt.functions}
+			_, result, err := collectCompletion(strings.NewReader(upstreamBody(tt.events...)), req)
+			if err != nil {
+				t.Fatalf("collectCompletion: %v", err)
+			}
+			if result.FinishReason != tt.want {
+				t.Errorf("finish_reason = %q, want %q", result.FinishReason, tt.want)
+			}
+			if legacy := result.FunctionCall != nil; legacy != (tt.want == "function_call") {
+				t.Errorf("function_call set = %v with finish_reason %q", legacy, result.FinishReason)
+			}
+		})
+	}
+}
+
+func TestSplitUTF8(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		size int
+		want []string
+	}{
+		{"shorter than size", "abc", 4, []string{"abc"}},
+		{"exact size", "abcd", 4, []string{"abcd"}},
+		{"ascii", "abcdefghij", 4, []string{"abcd", "efgh", "ij"}},
+		{"rune at boundary", "abc世界", 4, []string{"abc", "世", "界"}},
+		{"two-byte runes", "ééé", 3, []string{"é", "é", "é"}},
+		{"size smaller than rune", "世界", 2, []string{"世", "界"}},
+		{"four-byte rune", "a🙂b", 3, []string{"a", "🙂", "b"}},
+		{"disabled", "abcdefghij", 0, []string{"abcdefghij"}},
+		{"empty", "", 4, []string{""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitUTF8(tt.in, tt.size)
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("splitUTF8(%q, %d) = %q, want %q", tt.in, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamHugeEvent(t *testing.T) {
+	// One upstream line well past bufio.Scanner's 64 KiB default, with
+	// multibyte runes throughout so chunk edges land inside them.
+	content := strings.Repeat("héllo, 世界 🙂 ", 6000)
+	if len(content) <= 64<<10 {
+		t.Fatalf("fixture is only %d bytes", len(content))
+	}
+	for _, size := range []int{1024, 1000, 7} {
+		t.Run("CHUNK_SIZE="+strconv.Itoa(size), func(t *testing.T) {
+			setConfig(t, &CHUNK_SIZE, size)
+			req := &OpenAIRequest{Model: "GLM-4.5"}
+			contents := chunkContents(streamFixture(t, req, strings.NewReader(upstreamBody(answerEvent(content)))))
+			if len(contents) < len(content)/size {
+				t.Errorf("got %d content chunks, want at least %d", len(contents), len(content)/size)
+			}
+			for i, piece := range contents {
+				if len(piece) > size && utf8.RuneCountInString(piece) > 1 {
+					t.Errorf("chunk %d is %d bytes, over CHUNK_SIZE", i, len(piece))
+				}
+				if !utf8.ValidString(piece) || strings.ContainsRune(piece, utf8.RuneError) {
+					t.Fatalf("chunk %d is not clean UTF-8: %q", i, piece)
+				}
+			}
+			if got := strings.Join(contents, ""); got != content {
+				t.Errorf("reassembled content differs: %d bytes, want %d", len(got), len(content))
+			}
+		})
+	}
+}
+
+func TestStreamHugeEventUnsplit(t *testing.T) {
+	setConfig(t, &CHUNK_SIZE, 0)
+	content := strings.Repeat("x", 100<<10)
+	contents := chunkContents(streamFixture(t, &OpenAIRequest{Model: "GLM-4.5"}, strings.NewReader(upstreamBody(answerEvent(content)))))
+	if len(contents) != 1 || contents[0] != content {
+		t.Errorf("got %d content chunks, want the whole event in one", len(contents))
+	}
+}
+
+// sdkEvents decodes an SSE body the way openai-python's SSEDecoder and
+// Stream do: "data:" lines are joined until a blank line dispatches the
+// event, [DONE] ends the stream, and every other event must be a JSON object.
+func sdkEvents(t *testing.T, body string) []map[string]any {
+	t.Helper()
+	var events []map[string]any
+	var data []string
+	for _, line := range strings.Split(body, "\n") {
+		if line != "" {
+			if value, ok := strings.CutPrefix(line, "data:"); ok {
+				data = append(data, strings.TrimPrefix(value, " "))
+			}
+			continue
+		}
+		if data == nil {
+			continue
+		}
+		payload := strings.Join(data, "\n")
+		data = nil
+		if payload == "[DONE]" {
+			return events
+		}
+		var event map[string]any
+		if err := json.Unmarshal([]byte(payload), &event); err != nil {
+			t.Fatalf("event is not a JSON object: %s", payload)
+		}
+		if _, ok := event["error"]; ok {
+			t.Fatalf("stream reported an error: %s", payload)
+		}
+		events = append(events, event)
+	}
+	t.Fatalf("stream ended without [DONE]")
+	return nil
+}
+
+// sdkUsage checks a chunk's usage as CompletionUsage declares it, with the
+// three token counts as required integers, and returns it; nil if absent.
+func sdkUsage(t *testing.T, event map[string]any) map[string]int {
+	t.Helper()
+	raw, ok := event["usage"]
+	if !ok || raw == nil {
+		return nil
+	}
+	fields, ok := raw.(map[string]any)
+	if !ok {
+		t.Fatalf("usage is %T, want an object", raw)
+	}
+	usage := map[string]int{}
+	for _, name := range []string{"prompt_tokens", "completion_tokens", "total_tokens"} {
+		n, ok := fields[name].(float64)
+		if !ok || n != float64(int(n)) || n < 0 {
+			t.Fatalf("usage.%s = %v, want a non-negative integer", name, fields[name])
+		}
+		usage[name] = int(n)
+	}
+	return usage
+}
+
+func TestStreamContinuousUsageStats(t *testing.T) {
+	body := upstreamBody(answerEvent("Hello"), answerEvent(", world"), answerEvent("! How are you today?"),
+		`{"type":"chat:completion","data":{"phase":"answer","usage":{"prompt_tokens":12,"completion_tokens":40,"total_tokens":52}}}`)
+	tests := []struct {
+		name       string
+		options    *StreamOptions
+		continuous bool
+	}{
+		{"no stream_options", nil, false},
+		{"include_usage", &StreamOptions{IncludeUsage: true}, false},
+		{"continuous_usage_stats", &StreamOptions{ContinuousUsageStats: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &OpenAIRequest{
+				Model:         "GLM-4.5",
+				Messages:      []Message{{Role: "user", Content: "Say hello"}},
+				StreamOptions: tt.options,
+			}
+			w := httptest.NewRecorder()
+			handleStreamResponse(w, strings.NewReader(body), req)
+			events := sdkEvents(t, w.Body.String())
+
+			last := 0
+			for i, event := range events {
+				if event["object"] != "chat.completion.chunk" {
+					t.Fatalf("event %d object = %v", i, event["object"])
+				}
+				choices, ok := event["choices"].([]any)
+				if !ok || len(choices) != 1 {
+					t.Fatalf("event %d choices = %v", i, event["choices"])
+				}
+				choice := choices[0].(map[string]any)
+				if _, ok := choice["delta"].(map[string]any); !ok {
+					t.Fatalf("event %d has no delta object", i)
+				}
+				final := i == len(events)-1
+				if reason, _ := choice["finish_reason"].(string); final != (reason != "") {
+					t.Errorf("event %d finish_reason = %q", i, reason)
+				}
+				content, _ := choice["delta"].(map[string]any)["content"].(string)
+				usage := sdkUsage(t, event)
+				switch {
+				case final:
+					if usage["completion_tokens"] != 40 || usage["total_tokens"] != 52 {
+						t.Fatalf("final chunk usage = %v, want the upstream's", usage)
+					}
+				case content != "" && tt.continuous:
+					if usage == nil {
+						t.Fatalf("content chunk %d has no usage", i)
+					}
+				case usage != nil:
+					t.Errorf("usage on chunk %d: %v", i, usage)
+				}
+				if usage == nil {
+					continue
+				}
+				if usage["total_tokens"] != usage["prompt_tokens"]+usage["completion_tokens"] {
+					t.Errorf("chunk %d usage does not add up: %v", i, usage)
+				}
+				if usage["completion_tokens"] < last {
+					t.Errorf("chunk %d completion_tokens went down: %d after %d", i, usage["completion_tokens"], last)
+				}
+				last = usage["completion_tokens"]
+			}
+			if last == 0 {
+				t.Errorf("completion_tokens never counted the content")
+			}
+		})
+	}
+}
+
+// splitReader returns its data in reads of the given sizes, then the rest.
+type splitReader struct {
+	data  string
+	sizes []int
+}
+
+func (r *splitReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, io.EOF
+	}
+	n := len(r.data)
+	if len(r.sizes) > 0 {
+		n, r.sizes = min(r.sizes[0], n), r.sizes[1:]
+	}
+	n = copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestReadUpstreamEventsReassembly(t *testing.T) {
+	hello := answerEvent("hello")
+	world := answerEvent("world")
+	tests := []struct {
+		name       string
+		body       string
+		sizes      []int
+		maxBytes   int
+		wantDeltas []string
+	}{
+		{
+			name:       "event split across reads",
+			body:       "data: " + hello + "\n\n",
+			sizes:      []int{20, 7, 3},
+			wantDeltas: []string{"hello"},
+		},
+		{
+			name:       "one byte per read",
+			body:       "data: " + hello + "\n\ndata: " + world + "\n\n",
+			sizes:      fixedReads(1, 200),
+			wantDeltas: []string{"hello", "world"},
+		},
+		{
+			name:       "json split over two data lines",
+			body:       "data: " + hello[:25] + "\ndata: " + hello[25:] + "\n\n",
+			wantDeltas: []string{"hello"},
+		},
+		{
+			name:       "json split over two data lines and reads",
+			body:       "data: " + hello[:25] + "\ndata: " + hello[25:] + "\n\ndata: " + world + "\n\n",
+			sizes:      []int{10, 25, 1, 9},
+			wantDeltas: []string{"hello", "world"},
+		},
+		{
+			name:       "json broken by a raw newline",
+			body:       "data: " + hello[:25] + "\n" + hello[25:] + "\n\n",
+			wantDeltas: []string{"hello"},
+		},
+		{
+			name:       "malformed event skipped at its end",
+			body:       "data: {\"type\":\n\ndata: " + world + "\n\n",
+			wantDeltas: []string{"world"},
+		},
+		{
+			name:       "complete event after an unfinished one",
+			body:       "data: {\"type\":\ndata: " + world + "\n\n",
+			wantDeltas: []string{"world"},
+		},
+		{
+			name:       "malformed event at EOF",
+			body:       "data: " + hello + "\n\ndata: {\"type\":",
+			wantDeltas: []string{"hello"},
+		},
+		{
+			name:       "over EVENT_REASSEMBLY_MAX_BYTES",
+			body:       "data: " + hello[:25] + "\ndata: " + hello[25:] + "\n\ndata: " + world + "\n\n",
+			maxBytes:   10,
+			wantDeltas: []string{"world"},
+		},
+		{
+			name:       "comments and other fields",
+			body:       ": keepalive\nevent: message\ndata: " + hello + "\n\n",
+			wantDeltas: []string{"hello"},
+		},
+		{
+			name:       "stops at [DONE]",
+			body:       "data: " + hello + "\n\ndata: [DONE]\n\ndata: " + world + "\n\n",
+			wantDeltas: []string{"hello"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.maxBytes != 0 {
+				setConfig(t, &EVENT_REASSEMBLY_MAX_BYTES, tt.maxBytes)
+			}
+			var deltas []string
+			err := readUpstreamEvents(&splitReader{data: tt.body, sizes: tt.sizes}, func(ev *UpstreamData) (bool, error) {
+				deltas = append(deltas, string(ev.Data.DeltaContent))
+				return false, nil
+			})
+			if err != nil {
+				t.Fatalf("readUpstreamEvents: %v", err)
+			}
+			if strings.Join(deltas, "|") != strings.Join(tt.wantDeltas, "|") {
+				t.Errorf("deltas = %q, want %q", deltas, tt.wantDeltas)
+			}
+		})
+	}
+}
+
+// fixedReads returns n reads of size bytes, for splitReader.
+func fixedReads(size, n int) []int {
+	sizes := make([]int, n)
+	for i := range sizes {
+		sizes[i] = size
+	}
+	return sizes
+}
+
+func TestUTF8Carry(t *testing.T) {
+	tests := []struct {
+		name    string
+		pushes  []string
+		want    []string
+		pending int
+	}{
+		{"ascii", []string{"ab", "cd"}, []string{"ab", "cd"}, 0},
+		{"three-byte rune split", []string{"a\xe4\xb8", "\x96b"}, []string{"a", "世b"}, 0},
+		{"split after first byte", []string{"\xe4", "\xb8\x96"}, []string{"", "世"}, 0},
+		{"rune over three pushes", []string{"\xf0\x9f", "\x99", "\x82!"}, []string{"", "", "🙂!"}, 0},
+		{"two-byte rune split", []string{"caf\xc3", "\xa9"}, []string{"caf", "é"}, 0},
+		{"invalid byte", []string{"a\xffb"}, []string{"a�b"}, 0},
+		{"broken sequence", []string{"\xe4\xb8", "x"}, []string{"", "�x"}, 0},
+		{"incomplete at end", []string{"ok\xe4\xb8"}, []string{"ok"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c utf8Carry
+			for i, s := range tt.pushes {
+				if got := c.push(s); got != tt.want[i] {
+					t.Errorf("push %d (%q) = %q, want %q", i, s, got, tt.want[i])
+				}
+			}
+			if c.pending() != tt.pending {
+				t.Errorf("pending = %d, want %d", c.pending(), tt.pending)
+			}
+		})
+	}
+}
+
+func TestStreamMultibyteSplit(t *testing.T) {
+	// rawAnswer writes delta into the JSON untouched, as an upstream that
+	// cuts a character in half between two events does.
+	rawAnswer := func(delta string) string {
+		return `{"type":"chat:completion","data":{"phase":"answer","delta_content":"` + delta + `"}}`
+	}
+	tests := []struct {
+		name  string
+		body  string
+		sizes []int
+		want  string
+	}{
+		{
+			name: "rune split across events",
+			body: upstreamBody(rawAnswer("你好\xe4\xb8"), rawAnswer("\x96界")),
+			want: "你好世界",
+		},
+		{
+			name: "four-byte rune split across events",
+			body: upstreamBody(rawAnswer("hi \xf0\x9f"), rawAnswer("\x99\x82")),
+			want: "hi 🙂",
+		},
+		{
+			name:  "rune split across reads",
+			body:  upstreamBody(answerEvent("你好世界")),
+			sizes: []int{len(`data: {"type":"chat:completion","data":{"phase":"answer","delta_content":"你`) + 1, 1},
+			want:  "你好世界",
+		},
+		{
+			name: "invalid byte replaced",
+			body: upstreamBody(rawAnswer("a\xffb")),
+			want: "a�b",
+		},
+		{
+			name: "incomplete rune at the end dropped",
+			body: upstreamBody(rawAnswer("done\xe4\xb8")),
+			want: "done",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &OpenAIRequest{Model: "GLM-4.5"}
+			contents := chunkContents(streamFixture(t, req, &splitReader{data: tt.body, sizes: tt.sizes}))
+			for i, piece := range contents {
+				if !utf8.ValidString(piece) {
+					t.Errorf("chunk %d is not valid UTF-8: %q", i, piece)
+				}
+			}
+			if got := strings.Join(contents, ""); got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamOpensWithRoleChunk(t *testing.T) {
+	thinking := `{"type":"chat:completion","data":{"phase":"thinking","delta_content":"<details type=\"reasoning\" done=\"false\">\n> hmm"}}`
+	toolCall := `{"type":"chat:completion","data":{"phase":"answer","tool_calls":[{"id":"c1","function":{"name":"f","arguments":"{}"}}]}}`
+	tests := []struct {
+		name      string
+		thinkMode string
+		events    []string
+	}{
+		{"answer", "strip", []string{answerEvent("Hello"), answerEvent(" there")}},
+		{"reasoning first", "think", []string{thinking, answerEvent("Hello")}},
+		{"reasoning stripped", "strip", []string{thinking, answerEvent("Hello")}},
+		{"tool call only", "strip", []string{toolCall}},
+		{"no content", "strip", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &OpenAIRequest{Model: "GLM-4.5", thinkMode: tt.thinkMode}
+			chunks := streamFixture(t, req, strings.NewReader(upstreamBody(tt.events...)))
+			if len(chunks) < 2 {
+				t.Fatalf("got %d chunks, want the role chunk and a finish chunk", len(chunks))
+			}
+			first := chunks[0].Choices[0]
+			if first.Delta == nil || first.Delta.Role != "assistant" || first.Delta.Content == nil || *first.Delta.Content != "" {
+				t.Errorf("first chunk delta = %+v, want role assistant and empty content", first.Delta)
+			}
+			if first.FinishReason != "" || len(first.Delta.ToolCalls) > 0 {
+				t.Errorf("first chunk carries more than the role: %+v", first)
+			}
+			for i, chunk := range chunks[1:] {
+				if delta := chunk.Choices[0].Delta; delta != nil && delta.Role != "" {
+					t.Errorf("chunk %d repeats the role", i+1)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamEmptyAndDuplicateDeltas(t *testing.T) {
+	empty := `{"type":"chat:completion","data":{"phase":"answer","delta_content":""}}`
+	thinking := func(delta string) string {
+		text, _ := json.Marshal(delta)
+		return `{"type":"chat:completion","data":{"phase":"thinking","delta_content":` + string(text) + `}}`
+	}
+	tests := []struct {
+		name   string
+		dedupe bool
+		events []string
+		want   []string
+	}{
+		{"empty deltas dropped", false, []string{empty, answerEvent("a"), empty, empty, answerEvent("b"), empty}, []string{"a", "b"}},
+		{"only empty deltas", false, []string{empty, empty}, nil},
+		{"repeats kept by default", false, []string{answerEvent("Hi"), answerEvent("Hi")}, []string{"Hi", "Hi"}},
+		{"consecutive repeat skipped", true, []string{answerEvent("Hi"), answerEvent("Hi"), answerEvent(" there")}, []string{"Hi", " there"}},
+		{"repeat across an empty delta", true, []string{answerEvent("Hi"), empty, answerEvent("Hi")}, []string{"Hi"}},
+		{"non-consecutive repeat kept", true, []string{answerEvent("a"), answerEvent("b"), answerEvent("a")}, []string{"a", "b", "a"}},
+		{"same text in another phase kept", true, []string{thinking("ok"), answerEvent("ok")}, []string{"ok"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &DEDUPE_DELTAS, tt.dedupe)
+			req := &OpenAIRequest{Model: "GLM-4.5", thinkMode: "strip"}
+			chunks := streamFixture(t, req, strings.NewReader(upstreamBody(tt.events...)))
+			for i, chunk := range chunks[1 : len(chunks)-1] {
+				if delta := chunk.Choices[0].Delta; delta == nil || delta.Content == nil || *delta.Content == "" {
+					t.Errorf("chunk %d carries no content: %+v", i+1, delta)
+				}
+			}
+			if got := chunkContents(chunks); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("contents = %q, want %q", got, tt.want)
+			}
+			if chunks[len(chunks)-1].Choices[0].FinishReason == "" {
+				t.Errorf("last chunk has no finish_reason")
+			}
+		})
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	upstream, feed := io.Pipe()
+	go func() {
+		io.WriteString(feed, "data: "+answerEvent("partial")+"\n\n")
+		// ...and then nothing, without closing.
+	}()
+	guard := newStreamGuard(upstream, 50*time.Millisecond, 0)
+	defer guard.Close()
+
+	var payloads []string
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		streamChunks(guard, &OpenAIRequest{Model: "GLM-4.5"}, "chatcmpl-test", func(payload []byte) error {
+			payloads = append(payloads, string(payload))
+			return nil
+		}, nil)
+	}()
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream still running long after STREAM_IDLE_TIMEOUT")
+	}
+
+	if n := len(payloads); n < 3 || payloads[n-1] != "[DONE]" {
+		t.Fatalf("payloads = %q, want content, an error event and [DONE]", payloads)
+	}
+	if !strings.Contains(payloads[1], `"content":"partial"`) {
+		t.Errorf("content before the stall was not sent: %s", payloads[1])
+	}
+	var errEvent ErrorResponse
+	if err := json.Unmarshal([]byte(payloads[len(payloads)-2]), &errEvent); err != nil || errEvent.Error.Code == nil {
+		t.Fatalf("second to last payload is not an error event: %s", payloads[len(payloads)-2])
+	}
+	if *errEvent.Error.Code != "stream_idle_timeout" {
+		t.Errorf("error code = %q, want stream_idle_timeout", *errEvent.Error.Code)
+	}
+	// The upstream body was closed, which is what cancels the request.
+	if _, err := io.WriteString(feed, "data: "+answerEvent("late")+"\n\n"); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("write to the stalled upstream = %v, want io.ErrClosedPipe", err)
+	}
+}
+
+func TestStreamIdleTimeoutResetByData(t *testing.T) {
+	upstream, feed := io.Pipe()
+	go func() {
+		for _, word := range []string{"one ", "two ", "three ", "four ", "five"} {
+			time.Sleep(20 * time.Millisecond)
+			io.WriteString(feed, "data: "+answerEvent(word)+"\n\n")
+		}
+		feed.Close()
+	}()
+	// Longer than each gap, shorter than the whole stream.
+	guard := newStreamGuard(upstream, 60*time.Millisecond, 0)
+	defer guard.Close()
+	chunks := streamFixture(t, &OpenAIRequest{Model: "GLM-4.5"}, guard)
+	if got := strings.Join(chunkContents(chunks), ""); got != "one two three four five" {
+		t.Errorf("content = %q, want the whole stream", got)
+	}
+}
+
+func TestTrimTrailing(t *testing.T) {
+	empty := `{"type":"chat:completion","data":{"phase":"answer","delta_content":""}}`
+	tests := []struct {
+		name   string
+		trim   bool
+		events []string
+		want   []string
+	}{
+		{"trailing newline", true, []string{answerEvent("Hello"), answerEvent(" world\n")}, []string{"Hello", " world"}},
+		{"whitespace-only final delta", true, []string{answerEvent("Hello"), answerEvent("\n\n  ")}, []string{"Hello"}},
+		{"empty final delta", true, []string{answerEvent("Hello"), empty}, []string{"Hello"}},
+		{"inner whitespace kept", true, []string{answerEvent("a \n"), answerEvent("b\t"), answerEvent(" c")}, []string{"a", " \nb", "\t c"}},
+		{"leading whitespace kept", true, []string{answerEvent("  indented")}, []string{"  indented"}},
+		{"only whitespace", true, []string{answerEvent(" \n ")}, nil},
+		{"off", false, []string{answerEvent("Hello"), answerEvent(" world\n"), answerEvent("\n")}, []string{"Hello", " world\n", "\n"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &TRIM_TRAILING, tt.trim)
+			req := &OpenAIRequest{Model: "GLM-4.5"}
+			body := upstreamBody(tt.events...)
+			chunks := streamFixture(t, req, strings.NewReader(body))
+			if got := chunkContents(chunks); strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("stream contents = %q, want %q", got, tt.want)
+			}
+			for i, chunk := range chunks[1 : len(chunks)-1] {
+				if delta := chunk.Choices[0].Delta; delta == nil || delta.Content == nil || *delta.Content == "" {
+					t.Errorf("chunk %d carries no content", i+1)
+				}
+			}
+			if last := chunks[len(chunks)-1].Choices[0]; last.FinishReason != "stop" {
+				t.Errorf("finish chunk = %+v, want finish_reason stop", last)
+			}
+
+			content, _, err := collectCompletion(strings.NewReader(body), req)
+			if err != nil {
+				t.Fatalf("collectCompletion: %v", err)
+			}
+			if want := strings.Join(tt.want, ""); content != want {
+				t.Errorf("non-stream content = %q, want %q", content, want)
+			}
+		})
+	}
+}
+
+func TestToolCallDetection(t *testing.T) {
+	weather := json.RawMessage(`{"type":"function","function":{"name":"get_weather"}}`)
+	clock := json.RawMessage(`{"type":"function","function":{"name":"get_time"}}`)
+	type call struct{ name, arguments string }
+	tests := []struct {
+		name        string
+		detect      bool
+		tools       []json.RawMessage
+		deltas      []string
+		wantContent string
+		wantCalls   []call
+	}{
+		{
+			name:        "fenced call split across deltas",
+			detect:      true,
+			tools:       []json.RawMessage{weather},
+			deltas:      []string{"Calling it.\n``", "`json\n{\"name\": \"get_weather\", \"argu", "ments\": {\"city\": \"Paris\"}}\n```\n"},
+			wantContent: "Calling it.\n\n",
+			wantCalls:   []call{{"get_weather", `{"city": "Paris"}`}},
+		},
+		{
+			name:      "arguments as a string",
+			detect:    true,
+			tools:     []json.RawMessage{weather},
+			deltas:    []string{"```\n{\"name\":\"get_weather\",\"arguments\":\"{\\\"city\\\":\\\"Oslo\\\"}\"}\n```"},
+			wantCalls: []call{{"get_weather", `{"city":"Oslo"}`}},
+		},
+		{
+			name:      "parameters instead of arguments",
+			detect:    true,
+			tools:     []json.RawMessage{weather},
+			deltas:    []string{"```json\n{\"name\":\"get_weather\",\"parameters\":{}}\n```"},
+			wantCalls: []call{{"get_weather", `{}`}},
+		},
+		{
+			name:      "array of calls",
+			detect:    true,
+			tools:     []json.RawMessage{weather, clock},
+			deltas:    []string{"```json\n[{\"name\":\"get_weather\",\"arguments\":{}},{\"name\":\"get_time\",\"arguments\":{}}]\n```"},
+			wantCalls: []call{{"get_weather", `{}`}, {"get_time", `{}`}},
+		},
+		{
+			name:      "tool_calls object",
+			detect:    true,
+			tools:     []json.RawMessage{clock},
+			deltas:    []string{"```json\n{\"tool_calls\":[{\"name\":\"get_time\",\"arguments\":{}}]}\n```"},
+			wantCalls: []call{{"get_time", `{}`}},
+		},
+		{
+			name:        "undeclared tool",
+			detect:      true,
+			tools:       []json.RawMessage{weather},
+			deltas:      []string{"```json\n{\"name\":\"rm_rf\",\"arguments\":{}}\n```"},
+			wantContent: "```json\n{\"name\":\"rm_rf\",\"arguments\":{}}\n```",
+		},
+		{
+			name:        "ordinary json",
+			detect:      true,
+			tools:       []json.RawMessage{weather},
+			deltas:      []string{"Here:\n```json\n{\"city\": \"Paris\"}\n```\nDone."},
+			wantContent: "Here:\n```json\n{\"city\": \"Paris\"}\n```\nDone.",
+		},
+		{
+			name:        "no fence",
+			detect:      true,
+			tools:       []json.RawMessage{weather},
+			deltas:      []string{"The weather ", "is `fine`", " today`"},
+			wantContent: "The weather is `fine` today`",
+		},
+		{
+			name:        "unclosed fence",
+			detect:      true,
+			tools:       []json.RawMessage{weather},
+			deltas:      []string{"```json\n{\"name\":\"get_weather\""},
+			wantContent: "```json\n{\"name\":\"get_weather\"",
+		},
+		{
+			name:        "no tools declared",
+			detect:      true,
+			deltas:      []string{"```json\n{\"name\":\"get_weather\",\"arguments\":{}}\n```"},
+			wantContent: "```json\n{\"name\":\"get_weather\",\"arguments\":{}}\n```",
+		},
+		{
+			name:        "off",
+			tools:       []json.RawMessage{weather},
+			deltas:      []string{"```json\n{\"name\":\"get_weather\",\"arguments\":{}}\n```"},
+			wantContent: "```json\n{\"name\":\"get_weather\",\"arguments\":{}}\n```",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(t, &TOOL_CALL_DETECTION, tt.detect)
+			req := &OpenAIRequest{Model: "GLM-4.5", Tools: tt.tools}
+			events := make([]string, len(tt.deltas))
+			for i, delta := range tt.deltas {
+				events[i] = answerEvent(delta)
+			}
+			chunks := streamFixture(t, req, strings.NewReader(upstreamBody(events...)))
+			if got := strings.Join(chunkContents(chunks), ""); got != tt.wantContent {
+				t.Errorf("content = %q, want %q", got, tt.wantContent)
+			}
+			var calls []call
+			for _, chunk := range chunks {
+				for _, tc := range chunk.Choices[0].Delta.ToolCalls {
+					if !strings.HasPrefix(tc.ID, "call_") || tc.Type != "function" {
+						t.Errorf("tool call id %q, type %q", tc.ID, tc.Type)
+					}
+					calls = append(calls, call{tc.Function.Name, tc.Function.Arguments})
+				}
+			}
+			if fmt.Sprint(calls) != fmt.Sprint(tt.wantCalls) {
+				t.Errorf("tool calls = %v, want %v", calls, tt.wantCalls)
+			}
+			wantFinish := "stop"
+			if len(tt.wantCalls) > 0 {
+				wantFinish = "tool_calls"
+			}
+			if got := chunks[len(chunks)-1].Choices[0].FinishReason; got != wantFinish {
+				t.Errorf("finish_reason = %q, want %q", got, wantFinish)
+			}
+		})
+	}
+}
+
+func TestCitationAnnotationsWithinCap(t *testing.T) {
+	body := upstreamBody(answerEvent("The answer, with sources."))
+	citations := []Citation{{Title: "One", URL: "https://one.example"}, {Title: "Two", URL: "https://two.example"}}
+	for limit := 0; limit <= 40; limit++ {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			setConfig(t, &MAX_OUTPUT_TOKENS_CAP, limit)
+			var content strings.Builder
+			tr := newTranslator(&OpenAIRequest{Model: "GLM-4.5"}, func(s string) error {
+				content.WriteString(s)
+				return nil
+			})
+			tr.citations = citations
+			result, err := tr.run(strings.NewReader(body))
+			if err != nil {
+				t.Fatalf("run: %v", err)
+			}
+			if limit == 0 && len(result.Annotations) != len(citations) {
+				t.Errorf("uncapped output has %d annotations, want %d", len(result.Annotations), len(citations))
+			}
+			runes := []rune(content.String())
+			for _, a := range result.Annotations {
+				c := a.URLCitation
+				if c.EndIndex > len(runes) {
+					t.Fatalf("annotation %+v ends past the %d runes of content %q", c, len(runes), content.String())
+				}
+				if got := string(runes[c.StartIndex:c.EndIndex]); !strings.Contains(got, c.URL) {
+					t.Errorf("annotation for %s covers %q", c.URL, got)
+				}
+			}
+		})
+	}
+}
+
+func TestCollectCompletionPartialOnTimeout(t *testing.T) {
+	setConfig(t, &RETURN_PARTIAL_ON_TIMEOUT, "length")
+	thinking := `{"type":"chat:completion","data":{"phase":"thinking","delta_content":"<details type=\"reasoning\" done=\"false\">\n> hmm"}}`
+	events := "data: " + thinking + "\n\n"
+	body := io.MultiReader(strings.NewReader(events), iotest.ErrReader(context.DeadlineExceeded))
+	req := &OpenAIRequest{Model: "GLM-4.5", thinkMode: "think"}
+	text, result, err := collectCompletion(body, req)
+	if err != nil {
+		t.Fatalf("collectCompletion: %v", err)
+	}
+	if !strings.HasSuffix(text, "</think>\n") {
+		t.Errorf("content %q leaves the thinking block open", text)
+	}
+	if result.FinishReason != "length" {
+		t.Errorf("finish_reason = %q, want length", result.FinishReason)
+	}
+	if result.EstimatedOutput == 0 {
+		t.Error("partial output is not counted in EstimatedOutput")
+	}
+}
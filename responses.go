@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ResponsesRequest is the body of POST /v1/responses. Only text and image
+// input is supported; it is mapped onto an OpenAIRequest and served by the
+// chat pipeline.
+type ResponsesRequest struct {
+	Model           string            `json:"model"`
+	Input           json.RawMessage   `json:"input"`
+	Instructions    string            `json:"instructions,omitempty"`
+	Stream          bool              `json:"stream,omitempty"`
+	Temperature     *float64          `json:"temperature,omitempty"`
+	TopP            *float64          `json:"top_p,omitempty"`
+	MaxOutputTokens *int              `json:"max_output_tokens,omitempty"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+}
+
+// responsesInputItem is one element of an array-valued input. Content is a
+// string or an array of input_text, input_image and output_text parts.
+type responsesInputItem struct {
+	Type    string          `json:"type"`
+	Role    string          `json:"role"`
+	Content json.RawMessage `json:"content"`
+}
+
+type responsesInputPart struct {
+	Type     string `json:"type"`
+	Text     string `json:"text"`
+	ImageURL string `json:"image_url"`
+	Detail   string `json:"detail"`
+}
+
+// ResponsesResponse is the Responses API reply, and the "response" object
+// carried by the lifecycle stream events.
+type ResponsesResponse struct {
+	ID                string             `json:"id"`
+	Object            string             `json:"object"`
+	CreatedAt         int64              `json:"created_at"`
+	Status            string             `json:"status"`
+	Model             string             `json:"model"`
+	Output            []ResponseItem     `json:"output"`
+	Usage             *ResponsesUsage    `json:"usage,omitempty"`
+	IncompleteDetails *IncompleteDetails `json:"incomplete_details,omitempty"`
+	Error             *ErrorDetail       `json:"error,omitempty"`
+	Metadata          map[string]string  `json:"metadata,omitempty"`
+}
+
+type ResponseItem struct {
+	Type    string            `json:"type"`
+	ID      string            `json:"id"`
+	Status  string            `json:"status"`
+	Role    string            `json:"role"`
+	Content []ResponseContent `json:"content"`
+}
+
+type ResponseContent struct {
+	Type        string       `json:"type"`
+	Text        string       `json:"text"`
+	Annotations []Annotation `json:"annotations"`
+}
+
+type ResponsesUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type IncompleteDetails struct {
+	Reason string `json:"reason"`
+}
+
+// handleResponses serves the Responses API on top of the chat pipeline.
+func handleResponses(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	switch r.Method {
+	case http.MethodPost:
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+		return
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		writeError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s is not supported on this endpoint; send a POST request with a JSON Responses API body", r.Method), "invalid_request_error", "method_not_allowed")
+		return
+	}
+	apiKey, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	var body ResponsesRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON", "invalid_request_error", "")
+		return
+	}
+	req, param, msg := body.chatRequest()
+	if msg != "" {
+		writeInvalidParam(w, param, msg)
+		return
+	}
+
+	if body.Stream {
+		stream := &responsesStreamWriter{w: w, sse: newSSEWriter(w), body: &body}
+		completeChat(stream, r, apiKey, req)
+		return
+	}
+	rec := &bufferedResponse{header: http.Header{}, status: http.StatusOK}
+	completeChat(rec, r, apiKey, req)
+	for name, values := range rec.header {
+		w.Header()[name] = values
+	}
+	if rec.status != http.StatusOK {
+		// Errors share the chat completions envelope.
+		w.WriteHeader(rec.status)
+		w.Write(rec.body.Bytes())
+		return
+	}
+	var completion OpenAIResponse
+	if err := json.Unmarshal(rec.body.Bytes(), &completion); err != nil || len(completion.Choices) == 0 {
+		writeError(w, http.StatusBadGateway, "Upstream returned no completion", "upstream_error", "")
+		return
+	}
+	resp := body.response(completion.Created)
+	choice := completion.Choices[0]
+	item := responseMessage("completed", "")
+	if choice.Message != nil {
+		item.Content[0].Text = choice.Message.Content
+		if choice.Message.Annotations != nil {
+			item.Content[0].Annotations = choice.Message.Annotations
+		}
+	}
+	resp.Output = []ResponseItem{item}
+	resp.Usage = responsesUsage(completion.Usage)
+	resp.finish(choice.FinishReason)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// chatRequest maps the Responses request onto a non-streaming or streaming
+// chat request. instructions become a leading system message.
+func (b *ResponsesRequest) chatRequest() (*OpenAIRequest, string, string) {
+	req := &OpenAIRequest{
+		Model:       b.Model,
+		Temperature: b.Temperature,
+		TopP:        b.TopP,
+		MaxTokens:   b.MaxOutputTokens,
+		Metadata:    b.Metadata,
+		Stream:      &b.Stream,
+	}
+	if b.Instructions != "" {
+		req.Messages = append(req.Messages, Message{Role: "system", Content: b.Instructions})
+	}
+	input := bytes.TrimSpace(b.Input)
+	if len(input) == 0 || bytes.Equal(input, []byte("null")) {
+		return nil, "input", "input is required"
+	}
+	if input[0] == '"' {
+		var text string
+		json.Unmarshal(input, &text)
+		req.Messages = append(req.Messages, Message{Role: "user", Content: text})
+		return req, "", ""
+	}
+	var items []responsesInputItem
+	if err := json.Unmarshal(input, &items); err != nil {
+		return nil, "input", "input must be a string or an array of message items"
+	}
+	for i, item := range items {
+		if item.Type != "" && item.Type != "message" {
+			return nil, fmt.Sprintf("input[%d].type", i), fmt.Sprintf("input item type %q is not supported; only message items are", item.Type)
+		}
+		msg, err := item.message()
+		if err != nil {
+			return nil, fmt.Sprintf("input[%d].content", i), err.Error()
+		}
+		req.Messages = append(req.Messages, msg)
+	}
+	return req, "", ""
+}
+
+func (item responsesInputItem) message() (Message, error) {
+	role := item.Role
+	if role == "developer" {
+		role = "system"
+	}
+	msg := Message{Role: role}
+	content := bytes.TrimSpace(item.Content)
+	if len(content) > 0 && content[0] == '"' {
+		err := json.Unmarshal(content, &msg.Content)
+		return msg, err
+	}
+	var parts []responsesInputPart
+	if err := json.Unmarshal(content, &parts); err != nil {
+		return msg, fmt.Errorf("content must be a string or an array of content parts")
+	}
+	for _, part := range parts {
+		switch part.Type {
+		case "input_text", "output_text":
+			msg.Parts = append(msg.Parts, ContentPart{Type: "text", Text: part.Text})
+		case "input_image":
+			msg.Parts = append(msg.Parts, ContentPart{Type: "image_url", ImageURL: &ImageURL{URL: part.ImageURL, Detail: part.Detail}})
+		default:
+			return msg, fmt.Errorf("content part type %q is not supported", part.Type)
+		}
+	}
+	msg.Content = partsText(msg.Parts)
+	return msg, nil
+}
+
+// response starts the reply object, without output yet.
+func (b *ResponsesRequest) response(created int64) *ResponsesResponse {
+	return &ResponsesResponse{
+		ID:        fmt.Sprintf("resp_%d", time.Now().UnixNano()),
+		Object:    "response",
+		CreatedAt: created,
+		Status:    "in_progress",
+		Model:     b.Model,
+		Output:    []ResponseItem{},
+		Metadata:  b.Metadata,
+	}
+}
+
+// finish sets the final status from a chat finish_reason.
+func (resp *ResponsesResponse) finish(finishReason string) {
+	resp.Status = "completed"
+	switch finishReason {
+	case "length":
+		resp.Status, resp.IncompleteDetails = "incomplete", &IncompleteDetails{Reason: "max_output_tokens"}
+	case "content_filter":
+		resp.Status, resp.IncompleteDetails = "incomplete", &IncompleteDetails{Reason: "content_filter"}
+	}
+	for i := range resp.Output {
+		resp.Output[i].Status = resp.Status
+	}
+}
+
+func responseMessage(status, text string) ResponseItem {
+	return ResponseItem{
+		Type:    "message",
+		ID:      fmt.Sprintf("msg_%d", time.Now().UnixNano()),
+		Status:  status,
+		Role:    "assistant",
+		Content: []ResponseContent{{Type: "output_text", Text: text, Annotations: []Annotation{}}},
+	}
+}
+
+func responsesUsage(u *Usage) *ResponsesUsage {
+	if u == nil {
+		return nil
+	}
+	return &ResponsesUsage{InputTokens: u.PromptTokens, OutputTokens: u.CompletionTokens, TotalTokens: u.TotalTokens}
+}
+
+// responsesStreamWriter turns the chat completion chunks written by the
+// pipeline into Responses API stream events. Replies that are not an event
+// stream, such as errors before the stream started, pass through as-is.
+type responsesStreamWriter struct {
+	w    http.ResponseWriter
+	sse  *sseWriter
+	body *ResponsesRequest
+	buf  []byte
+
+	resp     *ResponsesResponse
+	item     ResponseItem
+	text     strings.Builder
+	sequence int
+}
+
+func (s *responsesStreamWriter) Header() http.Header {
+	return s.w.Header()
+}
+
+func (s *responsesStreamWriter) WriteHeader(status int) {
+	s.w.WriteHeader(status)
+}
+
+func (s *responsesStreamWriter) Write(p []byte) (int, error) {
+	if !strings.HasPrefix(s.w.Header().Get("Content-Type"), "text/event-stream") {
+		return s.w.Write(p)
+	}
+	s.buf = append(s.buf, p...)
+	for {
+		s.buf = bytes.TrimLeft(s.buf, "\n")
+		event, rest, ok := bytes.Cut(s.buf, []byte("\n\n"))
+		if !ok {
+			return len(p), nil
+		}
+		s.buf = rest
+		data := sseData(event)
+		if data == nil {
+			// Keepalive comments keep the connection alive here too.
+			if err := s.sse.write(append(event, '\n')); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if err := s.chunk(data); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Flush is a no-op: events are flushed as they are sent.
+func (s *responsesStreamWriter) Flush() {}
+
+// chunk translates one chat completion chunk, or the closing [DONE].
+func (s *responsesStreamWriter) chunk(data []byte) error {
+	if bytes.Equal(data, []byte("[DONE]")) {
+		return nil
+	}
+	var failure ErrorResponse
+	if json.Unmarshal(data, &failure) == nil && failure.Error.Message != "" {
+		if err := s.start(0); err != nil {
+			return err
+		}
+		s.resp.Status, s.resp.Error = "failed", &failure.Error
+		return s.send("response.failed", map[string]interface{}{"response": s.resp})
+	}
+	var c OpenAIResponse
+	if err := json.Unmarshal(data, &c); err != nil || len(c.Choices) == 0 {
+		return nil
+	}
+	if err := s.start(c.Created); err != nil {
+		return err
+	}
+	choice := c.Choices[0]
+	if choice.Delta != nil && choice.Delta.Content != nil && *choice.Delta.Content != "" {
+		s.text.WriteString(*choice.Delta.Content)
+		if err := s.send("response.output_text.delta", s.position(map[string]interface{}{"delta": *choice.Delta.Content})); err != nil {
+			return err
+		}
+	}
+	if choice.Delta != nil && choice.Delta.Annotations != nil {
+		s.item.Content[0].Annotations = choice.Delta.Annotations
+	}
+	if choice.FinishReason == "" {
+		return nil
+	}
+	return s.complete(choice.FinishReason, c.Usage)
+}
+
+// start sends the opening events before the first chunk.
+func (s *responsesStreamWriter) start(created int64) error {
+	if s.resp != nil {
+		return nil
+	}
+	if created == 0 {
+		created = time.Now().Unix()
+	}
+	s.resp = s.body.response(created)
+	s.item = responseMessage("in_progress", "")
+	if err := s.send("response.created", map[string]interface{}{"response": s.resp}); err != nil {
+		return err
+	}
+	if err := s.send("response.output_item.added", map[string]interface{}{"output_index": 0, "item": s.item}); err != nil {
+		return err
+	}
+	return s.send("response.content_part.added", s.position(map[string]interface{}{"part": s.item.Content[0]}))
+}
+
+// complete sends the closing events with the whole text and usage.
+func (s *responsesStreamWriter) complete(finishReason string, usage *Usage) error {
+	s.item.Content[0].Text = s.text.String()
+	s.resp.Output = []ResponseItem{s.item}
+	s.resp.Usage = responsesUsage(usage)
+	s.resp.finish(finishReason)
+	s.item = s.resp.Output[0]
+	part := s.item.Content[0]
+	if err := s.send("response.output_text.done", s.position(map[string]interface{}{"text": part.Text})); err != nil {
+		return err
+	}
+	if err := s.send("response.content_part.done", s.position(map[string]interface{}{"part": part})); err != nil {
+		return err
+	}
+	if err := s.send("response.output_item.done", map[string]interface{}{"output_index": 0, "item": s.item}); err != nil {
+		return err
+	}
+	name := "response.completed"
+	if s.resp.Status == "incomplete" {
+		name = "response.incomplete"
+	}
+	return s.send(name, map[string]interface{}{"response": s.resp})
+}
+
+// position adds the fields locating a content event in the only output
+// item.
+func (s *responsesStreamWriter) position(event map[string]interface{}) map[string]interface{} {
+	event["item_id"] = s.item.ID
+	event["output_index"] = 0
+	event["content_index"] = 0
+	return event
+}
+
+func (s *responsesStreamWriter) send(name string, event map[string]interface{}) error {
+	event["type"] = name
+	event["sequence_number"] = s.sequence
+	s.sequence++
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return s.sse.named(name, data)
+}
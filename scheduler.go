@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// priorityClasses are the QoS classes of the scheduler, highest first.
+var priorityClasses = []string{"high", "normal", "low"}
+
+const defaultPriority = 1 // "normal"
+
+// priorityIndex returns the position of class in priorityClasses, or -1.
+func priorityIndex(class string) int {
+	for i, c := range priorityClasses {
+		if c == class {
+			return i
+		}
+	}
+	return -1
+}
+
+// requestPriority picks the class of a request from its X-Priority header,
+// capped at the key's KEY_PRIORITIES class (normal by default) so callers
+// can lower their priority but not raise it. ok is false for an unknown
+// class name.
+func requestPriority(header, key string) (priority int, ok bool) {
+	limit := defaultPriority
+	if class, found := KEY_PRIORITIES[key]; found {
+		limit = priorityIndex(class)
+	}
+	if header == "" {
+		return limit, true
+	}
+	priority = priorityIndex(strings.ToLower(strings.TrimSpace(header)))
+	if priority < 0 {
+		return 0, false
+	}
+	return max(priority, limit), true
+}
+
+// fairScheduler bounds concurrent upstream work and, when requests have to
+// wait, hands out free slots by priority class and, within a class,
+// round-robin across API keys instead of in arrival order, so one busy key
+// cannot starve the others. Priority only orders the queue: running
+// requests are never interrupted.
+type fairScheduler struct {
+	mu      sync.Mutex
+	limit   int
+	running int
+	classes []*schedClass // indexed like priorityClasses
+}
+
+// schedClass holds the waiters of one priority class.
+type schedClass struct {
+	queues map[string][]*schedWaiter
+	ring   []string // keys with pending waiters, in round-robin order
+	next   int
+}
+
+type schedWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newFairScheduler(limit int) *fairScheduler {
+	s := &fairScheduler{limit: limit}
+	for range priorityClasses {
+		s.classes = append(s.classes, &schedClass{queues: map[string][]*schedWaiter{}})
+	}
+	return s
+}
+
+// acquire blocks until key may run a request of the given priority (an
+// index into priorityClasses) or ctx is done. The returned release func must
+// be called exactly once when the request finishes.
+func (s *fairScheduler) acquire(ctx context.Context, key string, priority int) (func(), error) {
+	if s == nil || s.limit <= 0 {
+		return func() {}, nil
+	}
+	s.mu.Lock()
+	if s.running < s.limit && s.waiting() == 0 {
+		s.running++
+		s.mu.Unlock()
+		return s.release, nil
+	}
+	class := s.classes[priority]
+	wt := &schedWaiter{ready: make(chan struct{})}
+	if len(class.queues[key]) == 0 {
+		class.ring = append(class.ring, key)
+	}
+	class.queues[key] = append(class.queues[key], wt)
+	s.mu.Unlock()
+
+	select {
+	case <-wt.ready:
+		return s.release, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		if wt.granted {
+			// Lost the race: the slot was handed over as ctx ended.
+			s.mu.Unlock()
+			s.release()
+		} else {
+			class.remove(key, wt)
+			s.mu.Unlock()
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (s *fairScheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	for s.running < s.limit {
+		wt := s.dequeue()
+		if wt == nil {
+			return
+		}
+		wt.granted = true
+		s.running++
+		close(wt.ready)
+	}
+}
+
+// dequeue takes the next waiter from the highest non-empty class. Callers
+// hold s.mu.
+func (s *fairScheduler) dequeue() *schedWaiter {
+	for _, class := range s.classes {
+		if len(class.ring) == 0 {
+			continue
+		}
+		if class.next >= len(class.ring) {
+			class.next = 0
+		}
+		key := class.ring[class.next]
+		queue := class.queues[key]
+		wt := queue[0]
+		class.queues[key] = queue[1:]
+		if len(class.queues[key]) == 0 {
+			delete(class.queues, key)
+			class.ring = append(class.ring[:class.next], class.ring[class.next+1:]...)
+		} else {
+			class.next++
+		}
+		return wt
+	}
+	return nil
+}
+
+// waiting counts keys with queued requests in any class. Callers hold s.mu.
+func (s *fairScheduler) waiting() int {
+	n := 0
+	for _, class := range s.classes {
+		n += len(class.ring)
+	}
+	return n
+}
+
+// remove drops a waiter that gave up. Callers hold the scheduler's mu.
+func (c *schedClass) remove(key string, wt *schedWaiter) {
+	queue := c.queues[key]
+	for i, q := range queue {
+		if q == wt {
+			c.queues[key] = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	if len(c.queues[key]) > 0 {
+		return
+	}
+	delete(c.queues, key)
+	for i, k := range c.ring {
+		if k == key {
+			c.ring = append(c.ring[:i], c.ring[i+1:]...)
+			if c.next > i {
+				c.next--
+			}
+			break
+		}
+	}
+}
+
+// queueDepths returns the number of waiting requests per key label.
+func (s *fairScheduler) queueDepths() map[string]float64 {
+	depths := map[string]float64{}
+	if s == nil {
+		return depths
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, class := range s.classes {
+		for key, queue := range class.queues {
+			depths[labels("key", keyLabel(key))] += float64(len(queue))
+		}
+	}
+	return depths
+}
+
+// classDepths returns the number of waiting requests per priority class.
+func (s *fairScheduler) classDepths() map[string]float64 {
+	depths := map[string]float64{}
+	for _, name := range priorityClasses {
+		depths[labels("class", name)] = 0
+	}
+	if s == nil {
+		return depths
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, class := range s.classes {
+		for _, queue := range class.queues {
+			depths[labels("class", priorityClasses[i])] += float64(len(queue))
+		}
+	}
+	return depths
+}
+
+func (s *fairScheduler) runningCount() map[string]float64 {
+	if s == nil {
+		return map[string]float64{"": 0}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]float64{"": float64(s.running)}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// omittableResponseFields are the top-level response and chunk fields a
+// client may ask to leave out. id and choices are always sent.
+var omittableResponseFields = []string{"object", "created", "model", "system_fingerprint", "usage", "x_upstream_chat_id"}
+
+// parseOmitFields reads a comma-separated OMIT_RESPONSE_FIELDS or
+// X-Omit-Fields list.
+func parseOmitFields(list string) ([]string, error) {
+	var fields []string
+	for _, field := range strings.Split(list, ",") {
+		if field = strings.TrimSpace(field); field == "" {
+			continue
+		}
+		if !contains(omittableResponseFields, field) {
+			return nil, fmt.Errorf("%q cannot be omitted (omittable fields: %s)", field, strings.Join(omittableResponseFields, ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// responseOmitFields combines OMIT_RESPONSE_FIELDS with the request's
+// X-Omit-Fields header.
+func responseOmitFields(header http.Header) ([]string, error) {
+	fields, err := parseOmitFields(header.Get("X-Omit-Fields"))
+	if err != nil {
+		return nil, fmt.Errorf("X-Omit-Fields: %v", err)
+	}
+	return append(fields, OMIT_RESPONSE_FIELDS...), nil
+}
+
+// omitFields is the response-shaping step: it drops the omit fields from a
+// marshalled top-level JSON object, keeping the order of the rest. Anything
+// it cannot parse is returned unchanged.
+func omitFields(data []byte, omit []string) []byte {
+	if len(omit) == 0 {
+		return data
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return data
+	}
+	var out bytes.Buffer
+	out.WriteByte('{')
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return data
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return data
+		}
+		if contains(omit, key) {
+			continue
+		}
+		if out.Len() > 1 {
+			out.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		out.Write(name)
+		out.WriteByte(':')
+		out.Write(value)
+	}
+	out.WriteByte('}')
+	return out.Bytes()
+}
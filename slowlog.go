@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// requestTimings records when a request passed each stage, for the
+// SLOW_REQUEST_THRESHOLD log. Stages a request never reached stay zero.
+type requestTimings struct {
+	admitted   time.Time // got a concurrency slot
+	upstream   time.Time // upstream response headers arrived
+	firstToken time.Time // first content chunk sent (streaming only)
+}
+
+// logSlowRequest warns about a request that took longer than
+// SLOW_REQUEST_THRESHOLD, with where the time went: waiting for a slot,
+// waiting for the upstream to answer, and until the first streamed token.
+func logSlowRequest(req *OpenAIRequest, start time.Time) {
+	total := time.Since(start)
+	if SLOW_REQUEST_THRESHOLD <= 0 || total < SLOW_REQUEST_THRESHOLD {
+		return
+	}
+	t := req.timings
+	log.Printf("Slow request %s: model=%s key=%s total=%s queue=%s upstream=%s first_token=%s",
+		req.requestID, req.Model, keyLabel(req.apiKey), total.Round(time.Millisecond),
+		stageDuration(start, t.admitted), stageDuration(t.admitted, t.upstream), stageDuration(start, t.firstToken))
+}
+
+func stageDuration(from, to time.Time) string {
+	if from.IsZero() || to.IsZero() {
+		return "-"
+	}
+	return to.Sub(from).Round(time.Millisecond).String()
+}
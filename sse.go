@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func setSSEHeaders(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+}
+
+// sseWriter frames and flushes server-sent events. It is safe for
+// concurrent use, so keepalive comments can interleave with events.
+type sseWriter struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+func newSSEWriter(w http.ResponseWriter) *sseWriter {
+	flusher, _ := w.(http.Flusher)
+	return &sseWriter{w: w, flusher: flusher}
+}
+
+// event writes one `data:` event, preceded by an `id:` line when id is set.
+// The whole frame goes out in a single write so events never interleave.
+func (s *sseWriter) event(id string, payload []byte) error {
+	var frame []byte
+	if id != "" {
+		frame = fmt.Appendf(frame, "id: %s\n", id)
+	}
+	frame = fmt.Appendf(frame, "data: %s\n", payload)
+	return s.write(frame)
+}
+
+// named writes an event with an `event:` type line, as the Responses API
+// stream uses.
+func (s *sseWriter) named(event string, payload []byte) error {
+	return s.write(fmt.Appendf(nil, "event: %s\ndata: %s\n", event, payload))
+}
+
+// retry tells the client how long to wait before reconnecting.
+func (s *sseWriter) retry(d time.Duration) error {
+	return s.write(fmt.Appendf(nil, "retry: %d\n", d.Milliseconds()))
+}
+
+// comment writes an SSE comment line, which clients must ignore.
+func (s *sseWriter) comment(text string) error {
+	return s.write(fmt.Appendf(nil, ": %s\n", text))
+}
+
+// write terminates frame with the blank line that ends an event, plus one
+// more with SSE_EXTRA_NEWLINE, and flushes it.
+func (s *sseWriter) write(frame []byte) error {
+	frame = append(frame, '\n')
+	if SSE_EXTRA_NEWLINE {
+		frame = append(frame, '\n')
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(frame); err != nil {
+		return err
+	}
+	s.flush()
+	return nil
+}
+
+func (s *sseWriter) flush() {
+	if s.flusher != nil {
+		s.flusher.Flush()
+	}
+}
+
+// progressReporter sends SSE comments with the elapsed time and the
+// estimated prompt size until the first content arrives, so debugging UIs
+// can show that a long reasoning phase is still alive.
+type progressReporter struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func startProgress(sse *sseWriter, req *OpenAIRequest) *progressReporter {
+	p := &progressReporter{done: make(chan struct{})}
+	if !(DEBUG_MODE || req.streamProgress) || PROGRESS_INTERVAL <= 0 {
+		return p
+	}
+	start := time.Now()
+	promptTokens := modelTokenizer(req.Model).promptTokens(req.Messages)
+	go func() {
+		ticker := time.NewTicker(PROGRESS_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				elapsed := time.Since(start).Round(100 * time.Millisecond)
+				if sse.comment(fmt.Sprintf("processing elapsed=%s prompt_tokens=%d", elapsed, promptTokens)) != nil {
+					return
+				}
+			}
+		}
+	}()
+	return p
+}
+
+// stop ends the reports; it is safe to call more than once.
+func (p *progressReporter) stop() {
+	p.once.Do(func() { close(p.done) })
+}
+
+// replayStream keeps the most recent events of a stream so a client that
+// reconnects with Last-Event-ID can pick up where it left off. Event ids are
+// "<stream id>:<seq>" with seq starting at 1. Only the caller that started
+// the stream, with the same cacheIdentity, may resume it.
+type replayStream struct {
+	id      string
+	owner   string
+	mu      sync.Mutex
+	events  [][]byte
+	dropped int // events trimmed from the front of events
+	done    bool
+	changed chan struct{}
+	expires time.Time
+}
+
+var (
+	replayMu      sync.Mutex
+	replayStreams = map[string]*replayStream{}
+)
+
+func newReplayStream(id, owner string) *replayStream {
+	s := &replayStream{id: id, owner: owner, changed: make(chan struct{})}
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	now := time.Now()
+	for key, old := range replayStreams {
+		old.mu.Lock()
+		expired := old.done && now.After(old.expires)
+		old.mu.Unlock()
+		if expired {
+			delete(replayStreams, key)
+		}
+	}
+	replayStreams[id] = s
+	return s
+}
+
+// lookupReplay resolves a Last-Event-ID to its stream and the seq to resume
+// after. It fails when the stream is gone or the event was already trimmed.
+func lookupReplay(lastEventID string) (*replayStream, int, bool) {
+	i := strings.LastIndex(lastEventID, ":")
+	if i < 0 {
+		return nil, 0, false
+	}
+	seq, err := strconv.Atoi(lastEventID[i+1:])
+	if err != nil || seq < 0 {
+		return nil, 0, false
+	}
+	replayMu.Lock()
+	s := replayStreams[lastEventID[:i]]
+	replayMu.Unlock()
+	if s == nil {
+		return nil, 0, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq < s.dropped || seq > s.dropped+len(s.events) {
+		return nil, 0, false
+	}
+	return s, seq, true
+}
+
+func (s *replayStream) append(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, payload)
+	if over := len(s.events) - SSE_RESUME_BUFFER; over > 0 {
+		s.events = s.events[over:]
+		s.dropped += over
+	}
+	close(s.changed)
+	s.changed = make(chan struct{})
+	return nil
+}
+
+func (s *replayStream) finish() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.done = true
+	s.expires = time.Now().Add(SSE_RESUME_TTL)
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// tail writes the events after seq to w, following the stream live until it
+// finishes, the client goes away or ctx ends.
+func (s *replayStream) tail(ctx context.Context, sse *sseWriter, seq int) {
+	if err := sse.retry(SSE_RETRY); err != nil {
+		return
+	}
+	for {
+		s.mu.Lock()
+		if seq < s.dropped {
+			// The client fell further behind than the buffer reaches.
+			s.mu.Unlock()
+			return
+		}
+		pending := s.events[seq-s.dropped:]
+		done, changed := s.done, s.changed
+		s.mu.Unlock()
+
+		for _, payload := range pending {
+			seq++
+			if err := sse.event(fmt.Sprintf("%s:%d", s.id, seq), payload); err != nil {
+				return
+			}
+		}
+		if done && len(pending) == 0 {
+			return
+		}
+		if len(pending) > 0 {
+			continue
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// streamWithReplay decouples the upstream from the client connection: the
+// translated chunks go into a replay buffer that the client tails, so the
+// generation completes even if the client drops and comes back.
+func streamWithReplay(sse *sseWriter, body io.Reader, req *OpenAIRequest, id string, onContent func()) {
+	stream := newReplayStream(id, cacheIdentity(req.apiKey, req.modelScopes))
+	tailed := make(chan struct{})
+	go func() {
+		defer close(tailed)
+		stream.tail(context.Background(), sse, 0)
+	}()
+	streamChunks(body, req, id, stream.append, onContent)
+	stream.finish()
+	<-tailed
+}
+
+// resumeStream serves a reconnect carrying Last-Event-ID. It reports false
+// when there is nothing to resume, in which case the request is handled
+// from scratch. A stream started by another caller, or by the same JWT
+// subject with other scopes, is answered with 404.
+func resumeStream(w http.ResponseWriter, r *http.Request, apiKey string) bool {
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		return false
+	}
+	stream, seq, ok := lookupReplay(lastEventID)
+	if !ok {
+		debugLog("Cannot resume stream from Last-Event-ID %q, starting over", lastEventID)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(stream.owner), []byte(requestCacheIdentity(r, apiKey))) != 1 {
+		writeError(w, http.StatusNotFound, "No stream to resume for Last-Event-ID", "invalid_request_error", "stream_not_found")
+		return true
+	}
+	debugLog("Resuming stream %s after event %d", stream.id, seq)
+	setSSEHeaders(w)
+	stream.tail(r.Context(), newSSEWriter(w), seq)
+	return true
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strings"
+)
+
+// StatusPage is what GET / reports, so someone opening the proxy URL in a
+// browser can see it is up. It must never include keys or tokens.
+type StatusPage struct {
+	Service   string   `json:"service"`
+	Status    string   `json:"status"`
+	Version   string   `json:"version"`
+	GoVersion string   `json:"go_version"`
+	Models    []string `json:"models"`
+	Endpoints []string `json:"endpoints"`
+}
+
+var statusPageTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Service}}</title></head>
+<body style="font-family: sans-serif; max-width: 40em; margin: 2em auto">
+<h1>{{.Service}} is {{.Status}}</h1>
+<p>OpenAI-compatible API proxy for Z.ai. Version {{.Version}}, {{.GoVersion}}.</p>
+<h2>Models</h2>
+<ul>{{range .Models}}<li><code>{{.}}</code></li>{{end}}</ul>
+<h2>Endpoints</h2>
+<ul>{{range .Endpoints}}<li><code>{{.}}</code></li>{{end}}</ul>
+</body>
+</html>
+`))
+
+// buildVersion is the module version, or the VCS revision for builds from a
+// checkout.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" && (version == "" || version == "(devel)") {
+			version = setting.Value[:min(len(setting.Value), 12)]
+		}
+	}
+	if version == "" {
+		return "unknown"
+	}
+	return version
+}
+
+// handleRoot serves the status page on GET /, and handleOptions everywhere
+// else. ROOT_PAGE picks the format: "auto" sends HTML to browsers and JSON
+// to everything else.
+func handleRoot(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" || r.Method != http.MethodGet || ROOT_PAGE == "off" {
+		handleOptions(w, r)
+		return
+	}
+	setCORSHeaders(w)
+	models := getModelNames()
+	sort.Strings(models)
+	page := StatusPage{
+		Service:   "z2api",
+		Status:    "running",
+		Version:   buildVersion(),
+		GoVersion: runtime.Version(),
+		Models:    models,
+		Endpoints: []string{"POST /v1/chat/completions", "GET /v1/chat/completions/ws", "POST /v1/chat/completions/batch", "POST /v1/responses", "GET /v1/models", "GET /health", "GET /ready", "GET /metrics"},
+	}
+	if ENABLE_UI {
+		page.Endpoints = append(page.Endpoints, "GET /ui")
+	}
+	if ROOT_PAGE == "html" || ROOT_PAGE == "auto" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		statusPageTemplate.Execute(w, page)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
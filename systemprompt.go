@@ -0,0 +1,43 @@
+package main
+
+import "log"
+
+// systemPrompt is the operator's system prompt for model: its
+// MODEL_SYSTEM_PROMPTS entry, or else SYSTEM_PROMPT.
+func systemPrompt(model string) string {
+	if prompt, ok := MODEL_SYSTEM_PROMPTS[model]; ok {
+		return prompt
+	}
+	return SYSTEM_PROMPT
+}
+
+// applySystemPrompt injects the operator's system prompt according to
+// SYSTEM_PROMPT_MODE: "prepend" puts it before the client's messages,
+// "replace" also drops the client's system messages, and "skip" only adds it
+// when the client sent no system message of its own.
+func applySystemPrompt(req *OpenAIRequest) {
+	prompt := systemPrompt(req.Model)
+	if prompt == "" {
+		return
+	}
+	messages := make([]Message, 0, len(req.Messages)+1)
+	messages = append(messages, Message{Role: "system", Content: prompt})
+	for _, m := range req.Messages {
+		if m.Role != "system" {
+			messages = append(messages, m)
+			continue
+		}
+		switch SYSTEM_PROMPT_MODE {
+		case "replace":
+			continue
+		case "skip":
+			debugLog("Client sent a system message, not injecting the %s system prompt", req.Model)
+			return
+		}
+		messages = append(messages, m)
+	}
+	if SYSTEM_PROMPT_MODE == "replace" && len(messages) < len(req.Messages)+1 {
+		log.Printf("Replaced %d client system messages with the %s system prompt", len(req.Messages)+1-len(messages), req.Model)
+	}
+	req.Messages = messages
+}
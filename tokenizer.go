@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math"
+	"unicode"
+)
+
+// tokenizer approximates a model family's tokenizer without its vocabulary:
+// each CJK character and each other character has a fixed token cost. The
+// estimates are usually within 10-20% for prose, but can be far off for
+// code, URLs, numbers or mixed scripts.
+type tokenizer struct {
+	cjk   float64 // tokens per CJK character
+	other float64 // tokens per other character
+}
+
+// tokenizers are the estimators MODEL_TOKENIZER can choose from. GLM's
+// vocabulary merges common Chinese words, so it needs fewer tokens for CJK
+// text than a GPT BPE; generic is the one-per-character rule.
+var tokenizers = map[string]tokenizer{
+	"glm":     {cjk: 0.7, other: 0.25},
+	"gpt":     {cjk: 1.3, other: 0.25},
+	"generic": {cjk: 1, other: 0.25},
+}
+
+// defaultTokenizer serves models MODEL_TOKENIZER does not name.
+const defaultTokenizer = "glm"
+
+// modelTokenizerName is the estimator used for model.
+func modelTokenizerName(model string) string {
+	if name, ok := MODEL_TOKENIZER[model]; ok {
+		return name
+	}
+	return defaultTokenizer
+}
+
+func modelTokenizer(model string) tokenizer {
+	return tokenizers[modelTokenizerName(model)]
+}
+
+func (tk tokenizer) runeCost(r rune) float64 {
+	if isCJK(r) {
+		return tk.cjk
+	}
+	return tk.other
+}
+
+// cost is the unrounded estimate, so costs of consecutive pieces add up.
+func (tk tokenizer) cost(s string) float64 {
+	cost := 0.0
+	for _, r := range s {
+		cost += tk.runeCost(r)
+	}
+	return cost
+}
+
+// count estimates the tokens in s.
+func (tk tokenizer) count(s string) int {
+	return int(math.Ceil(tk.cost(s)))
+}
+
+// truncate cuts s once it would use more than budget tokens and returns the
+// kept part, the budget left and whether s was cut.
+func (tk tokenizer) truncate(s string, budget float64) (string, float64, bool) {
+	for i, r := range s {
+		cost := tk.runeCost(r)
+		if cost > budget {
+			return s[:i], 0, true
+		}
+		budget -= cost
+	}
+	return s, budget, false
+}
+
+// promptTokens approximates the prompt size of messages, counting a few
+// tokens of framing per message.
+func (tk tokenizer) promptTokens(messages []Message) int {
+	total := 0
+	for _, m := range messages {
+		total += 4 + tk.count(m.Content)
+	}
+	return total
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
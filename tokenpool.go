@@ -0,0 +1,132 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tokenPool rotates over the UPSTREAM_TOKEN list and quarantines tokens the
+// upstream keeps rejecting. After TOKEN_QUARANTINE_COOLDOWN a quarantined
+// token gets a single probe request: success returns it to rotation,
+// another rejection quarantines it again.
+type tokenPool struct {
+	mu     sync.Mutex
+	tokens []*pooledToken
+	next   int
+}
+
+type pooledToken struct {
+	value            string
+	failures         int // consecutive 401/429 replies
+	quarantinedUntil time.Time
+	probing          bool
+}
+
+var upstreamTokens = &tokenPool{}
+
+func newTokenPool(list string) *tokenPool {
+	pool := &tokenPool{}
+	for _, token := range strings.Split(list, ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			pool.tokens = append(pool.tokens, &pooledToken{value: token})
+		}
+	}
+	return pool
+}
+
+// pick returns the next usable token. When every token is quarantined the
+// one released soonest is used anyway, since failing outright is no better.
+func (p *tokenPool) pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	var soonest *pooledToken
+	for range p.tokens {
+		t := p.tokens[p.next]
+		p.next = (p.next + 1) % len(p.tokens)
+		switch {
+		case t.quarantinedUntil.IsZero():
+			return t.value
+		case !t.probing && now.After(t.quarantinedUntil):
+			t.probing = true
+			debugLog("Probing quarantined upstream token %s", keyLabel(t.value))
+			return t.value
+		}
+		if soonest == nil || t.quarantinedUntil.Before(soonest.quarantinedUntil) {
+			soonest = t
+		}
+	}
+	return soonest.value
+}
+
+// report records the upstream's reply to a request made with token. Only
+// 401 and 429 count against a token; other errors are not its fault.
+func (p *tokenPool) report(token string, status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var t *pooledToken
+	for _, candidate := range p.tokens {
+		if candidate.value == token {
+			t = candidate
+		}
+	}
+	if t == nil {
+		return
+	}
+	if status != http.StatusUnauthorized && status != http.StatusTooManyRequests {
+		if !t.quarantinedUntil.IsZero() {
+			log.Printf("Upstream token %s recovered, returning it to rotation", keyLabel(token))
+		}
+		t.failures, t.quarantinedUntil, t.probing = 0, time.Time{}, false
+		return
+	}
+	t.failures++
+	if t.probing || t.failures >= TOKEN_QUARANTINE_THRESHOLD {
+		t.quarantinedUntil, t.probing = time.Now().Add(TOKEN_QUARANTINE_COOLDOWN), false
+		log.Printf("Quarantining upstream token %s for %s after status %d (%d consecutive failures)", keyLabel(token), TOKEN_QUARANTINE_COOLDOWN, status, t.failures)
+	}
+}
+
+// states reports each token's health for /health. Tokens are identified by
+// keyLabel, as /health needs no authentication.
+func (p *tokenPool) states() []map[string]interface{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	states := make([]map[string]interface{}, 0, len(p.tokens))
+	for _, t := range p.tokens {
+		state := map[string]interface{}{"token": keyLabel(t.value), "state": t.state(), "failures": t.failures}
+		if !t.quarantinedUntil.IsZero() {
+			state["quarantined_until"] = t.quarantinedUntil.UTC().Format(time.RFC3339)
+		}
+		states = append(states, state)
+	}
+	return states
+}
+
+func (t *pooledToken) state() string {
+	switch {
+	case t.quarantinedUntil.IsZero():
+		return "healthy"
+	case t.probing:
+		return "probing"
+	}
+	return "quarantined"
+}
+
+// healthGauge backs z2api_upstream_token_healthy.
+func (p *tokenPool) healthGauge() map[string]float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	values := map[string]float64{}
+	for _, t := range p.tokens {
+		healthy := 0.0
+		if t.quarantinedUntil.IsZero() {
+			healthy = 1
+		}
+		values[labels("token", keyLabel(t.value))] = healthy
+	}
+	return values
+}
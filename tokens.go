@@ -0,0 +1,121 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// anonTokenCache keeps anonymous tokens for ANON_TOKEN_TTL and lets
+// concurrent callers share a single in-flight fetch. Tokens are cached per
+// scope: one shared scope, or one per upstream model with
+// ANON_TOKEN_PER_MODEL (see anonTokenScope).
+type anonTokenCache struct {
+	mu        sync.Mutex
+	entries   map[string]*anonTokenEntry
+	lastFetch time.Time // last successful fetch, for ANON_FETCH_MIN_INTERVAL
+}
+
+type anonTokenEntry struct {
+	token    string
+	fetched  time.Time
+	inflight *tokenFetch
+}
+
+type tokenFetch struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+var anonTokens = &anonTokenCache{entries: map[string]*anonTokenEntry{}}
+
+// anonTokenScope is the cache key for the anonymous token used with a
+// client-facing model.
+func anonTokenScope(model string) string {
+	if !ANON_TOKEN_PER_MODEL {
+		return ""
+	}
+	return MODEL_MAP[model]
+}
+
+// anonTokenScopes lists every scope in use, for warmup.
+func anonTokenScopes() []string {
+	if !ANON_TOKEN_PER_MODEL {
+		return []string{""}
+	}
+	seen := map[string]bool{}
+	var scopes []string
+	for _, upstream := range MODEL_MAP {
+		if !seen[upstream] {
+			seen[upstream] = true
+			scopes = append(scopes, upstream)
+		}
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+func (c *anonTokenCache) get(scope string) (string, error) {
+	c.mu.Lock()
+	e := c.entries[scope]
+	if e == nil {
+		e = &anonTokenEntry{}
+		c.entries[scope] = e
+	}
+	if e.token != "" && time.Since(e.fetched) < ANON_TOKEN_TTL {
+		token := e.token
+		c.mu.Unlock()
+		return token, nil
+	}
+	if f := e.inflight; f != nil {
+		c.mu.Unlock()
+		<-f.done
+		return f.token, f.err
+	}
+	// ANON_FETCH_MIN_INTERVAL caps how often we hit the auth endpoint: an
+	// expired token is reused until the interval has passed, and without one
+	// to reuse the fetch waits for it.
+	wait := ANON_FETCH_MIN_INTERVAL - time.Since(c.lastFetch)
+	if wait > 0 && e.token != "" {
+		token := e.token
+		c.mu.Unlock()
+		log.Printf("Anonymous token fetch suppressed by ANON_FETCH_MIN_INTERVAL, reusing the expired token (next fetch in %s)", wait.Round(time.Millisecond))
+		return token, nil
+	}
+	f := &tokenFetch{done: make(chan struct{})}
+	e.inflight = f
+	c.mu.Unlock()
+
+	if wait > 0 {
+		log.Printf("Anonymous token fetch delayed %s by ANON_FETCH_MIN_INTERVAL", wait.Round(time.Millisecond))
+		time.Sleep(wait)
+	}
+	f.token, f.err = getAnonymousToken()
+	if f.err == nil && scope != "" {
+		debugLog("Fetched anonymous token for %s", scope)
+	}
+
+	c.mu.Lock()
+	if f.err == nil {
+		e.token, e.fetched = f.token, time.Now()
+		c.lastFetch = e.fetched
+	}
+	e.inflight = nil
+	c.mu.Unlock()
+	close(f.done)
+	return f.token, f.err
+}
+
+// invalidate drops token wherever it is still cached, e.g. after the
+// upstream rejected it.
+func (c *anonTokenCache) invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		if e.token == token {
+			e.token = ""
+		}
+	}
+}
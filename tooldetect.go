@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// toolFence opens and closes the fenced blocks TOOL_CALL_DETECTION looks in.
+const toolFence = "```"
+
+// inlineToolCall is a tool call written out as JSON in the answer text.
+type inlineToolCall struct {
+	Name       string          `json:"name"`
+	Arguments  json.RawMessage `json:"arguments"`
+	Parameters json.RawMessage `json:"parameters"`
+}
+
+// declaredToolNames returns the function names req offers the model, from
+// tools or legacy functions.
+func declaredToolNames(req *OpenAIRequest) map[string]bool {
+	names := map[string]bool{}
+	for _, tool := range upstreamTools(req) {
+		var decl struct {
+			Function struct {
+				Name string `json:"name"`
+			} `json:"function"`
+		}
+		if json.Unmarshal(tool, &decl) == nil && decl.Function.Name != "" {
+			names[decl.Function.Name] = true
+		}
+	}
+	return names
+}
+
+// emitAnswer sends answer content, through scanToolCalls when
+// TOOL_CALL_DETECTION applies to the request.
+func (t *translator) emitAnswer(content string) error {
+	if t.toolNames == nil {
+		return t.emitNonEmpty(content)
+	}
+	return t.scanToolCalls(content)
+}
+
+// scanToolCalls implements TOOL_CALL_DETECTION for upstreams that write
+// tool calls into the answer instead of sending them structured. A fenced
+// block is held back until it closes; if it holds a call to one of the
+// declared tools it becomes a tool call, otherwise it is sent unchanged.
+func (t *translator) scanToolCalls(content string) error {
+	s := t.toolScan + content
+	t.toolScan = ""
+	for {
+		start := strings.Index(s, toolFence)
+		if start < 0 {
+			// A trailing "`" or "``" may be the start of a fence.
+			keep := 0
+			for n := len(toolFence) - 1; n > 0 && keep == 0; n-- {
+				if strings.HasSuffix(s, toolFence[:n]) {
+					keep = n
+				}
+			}
+			t.toolScan = s[len(s)-keep:]
+			return t.emitNonEmpty(s[:len(s)-keep])
+		}
+		if err := t.emitNonEmpty(s[:start]); err != nil {
+			return err
+		}
+		s = s[start:]
+		body, rest, ok := cutFence(s)
+		if !ok {
+			t.toolScan = s
+			return nil
+		}
+		if calls := t.parseInlineToolCalls(body); calls != nil {
+			debugLog("Detected %d tool calls in the answer text", len(calls))
+			t.inlineCalls = append(t.inlineCalls, calls...)
+		} else if err := t.emitNonEmpty(s[:len(s)-len(rest)]); err != nil {
+			return err
+		}
+		s = rest
+	}
+}
+
+// cutFence splits a complete fenced block at the start of s into its body
+// and the text after it. ok is false while the block is still open.
+func cutFence(s string) (body, rest string, ok bool) {
+	nl := strings.IndexByte(s, '\n')
+	if nl < 0 {
+		return "", "", false
+	}
+	end := strings.Index(s[nl+1:], toolFence)
+	if end < 0 {
+		return "", "", false
+	}
+	return s[nl+1 : nl+1+end], s[nl+1+end+len(toolFence):], true
+}
+
+// parseInlineToolCalls reads body as a tool call object
+// ({"name":...,"arguments":{...}}), an array of them, or an object with a
+// "tool_calls" array. It returns nil unless every call names a declared
+// tool, so ordinary JSON in an answer is left alone.
+func (t *translator) parseInlineToolCalls(body string) []ToolCall {
+	data := bytes.TrimSpace([]byte(body))
+	var wrapped struct {
+		ToolCalls []inlineToolCall `json:"tool_calls"`
+	}
+	var list []inlineToolCall
+	switch {
+	case len(data) > 0 && data[0] == '[':
+		if json.Unmarshal(data, &list) != nil {
+			return nil
+		}
+	case json.Unmarshal(data, &wrapped) == nil && len(wrapped.ToolCalls) > 0:
+		list = wrapped.ToolCalls
+	default:
+		var one inlineToolCall
+		if json.Unmarshal(data, &one) != nil {
+			return nil
+		}
+		list = []inlineToolCall{one}
+	}
+	if len(list) == 0 {
+		return nil
+	}
+	calls := make([]ToolCall, 0, len(list))
+	for _, c := range list {
+		args := c.Arguments
+		if args == nil {
+			args = c.Parameters
+		}
+		if !t.toolNames[c.Name] || args == nil {
+			return nil
+		}
+		// Arguments are a JSON string in the OpenAI shape; accept an object too.
+		var text string
+		if json.Unmarshal(args, &text) != nil {
+			text = string(args)
+		}
+		calls = append(calls, ToolCall{
+			ID:       "call_" + newRequestID()[:24],
+			Type:     "function",
+			Function: FunctionCall{Name: c.Name, Arguments: text},
+		})
+	}
+	return calls
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal OpenTelemetry tracer: spans are exported as OTLP/HTTP JSON to
+// OTEL_EXPORTER_OTLP_ENDPOINT. With no endpoint, startSpan returns nil and
+// every span method is a no-op, so disabled tracing costs nothing.
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu    sync.Mutex
+	attrs map[string]interface{}
+	err   bool
+}
+
+type spanContextKey struct{}
+
+// startServerSpan starts the span for an incoming request, continuing the
+// trace from its traceparent header when there is a valid one.
+func startServerSpan(r *http.Request, name string) *span {
+	if traceExporter == nil {
+		return nil
+	}
+	s := newSpan(name, spanKindServer)
+	if traceID, parentID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		s.traceID, s.parentID = traceID, parentID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	s.set("http.request.method", r.Method)
+	s.set("url.path", r.URL.Path)
+	return s
+}
+
+func newSpan(name string, kind int) *span {
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// child starts a span under s.
+func (s *span) child(name string, kind int) *span {
+	if s == nil {
+		return nil
+	}
+	c := newSpan(name, kind)
+	c.traceID, c.parentID = s.traceID, s.spanID
+	return c
+}
+
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attrs[key] = value
+	s.mu.Unlock()
+}
+
+// fail marks the span's status as an error.
+func (s *span) fail(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = true
+	s.attrs["error.message"] = err.Error()
+	s.mu.Unlock()
+}
+
+func (s *span) setUsage(usage *Usage) {
+	if usage != nil {
+		s.set("gen_ai.usage.input_tokens", usage.PromptTokens)
+		s.set("gen_ai.usage.output_tokens", usage.CompletionTokens)
+	}
+}
+
+func (s *span) end() {
+	if s == nil {
+		return
+	}
+	traceExporter.add(s, time.Now())
+}
+
+func spanFromContext(ctx context.Context) *span {
+	s, _ := ctx.Value(spanContextKey{}).(*span)
+	return s
+}
+
+// parseTraceparent reads a W3C traceparent header, version 00.
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, true
+}
+
+// traceRequests wraps a handler in a server span recording the status code.
+func traceRequests(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := startServerSpan(r, name)
+		if s == nil {
+			next(w, r)
+			return
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next(sw, r.WithContext(context.WithValue(r.Context(), spanContextKey{}, s)))
+		s.set("http.response.status_code", sw.status)
+		if sw.status >= 500 {
+			s.mu.Lock()
+			s.err = true
+			s.mu.Unlock()
+		}
+		s.end()
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if !sw.wroteHeader {
+		sw.status, sw.wroteHeader = status, true
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// otlpExporter batches finished spans and posts them every few seconds.
+type otlpExporter struct {
+	url     string
+	service string
+	mu      sync.Mutex
+	pending []map[string]interface{}
+}
+
+var traceExporter *otlpExporter
+
+const maxPendingSpans = 2048
+
+func initTracing() {
+	endpoint := getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	if endpoint == "" {
+		return
+	}
+	traceExporter = &otlpExporter{
+		url:     strings.TrimRight(endpoint, "/") + "/v1/traces",
+		service: getEnv("OTEL_SERVICE_NAME", "z2api"),
+	}
+	go func() {
+		for range time.Tick(5 * time.Second) {
+			traceExporter.flush()
+		}
+	}()
+	log.Printf("Exporting traces to %s", traceExporter.url)
+}
+
+func (e *otlpExporter) add(s *span, end time.Time) {
+	s.mu.Lock()
+	attrs := make([]map[string]interface{}, 0, len(s.attrs))
+	for k, v := range s.attrs {
+		attrs = append(attrs, otlpAttribute(k, v))
+	}
+	status := 1
+	if s.err {
+		status = 2
+	}
+	s.mu.Unlock()
+	encoded := map[string]interface{}{
+		"traceId":           hex.EncodeToString(s.traceID[:]),
+		"spanId":            hex.EncodeToString(s.spanID[:]),
+		"name":              s.name,
+		"kind":              s.kind,
+		"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+		"endTimeUnixNano":   strconv.FormatInt(end.UnixNano(), 10),
+		"attributes":        attrs,
+		"status":            map[string]int{"code": status},
+	}
+	if s.parentID != [8]byte{} {
+		encoded["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+	}
+	e.mu.Lock()
+	if len(e.pending) < maxPendingSpans {
+		e.pending = append(e.pending, encoded)
+	}
+	e.mu.Unlock()
+}
+
+func otlpAttribute(key string, value interface{}) map[string]interface{} {
+	var v map[string]interface{}
+	switch value := value.(type) {
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(value)}
+	case bool:
+		v = map[string]interface{}{"boolValue": value}
+	default:
+		v = map[string]interface{}{"stringValue": value}
+	}
+	return map[string]interface{}{"key": key, "value": v}
+}
+
+func (e *otlpExporter) flush() {
+	e.mu.Lock()
+	spans := e.pending
+	e.pending = nil
+	e.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []interface{}{otlpAttribute("service.name", e.service)},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "z2api"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		debugLog("Trace export failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		debugLog("Trace export rejected: status %d", resp.StatusCode)
+	}
+}
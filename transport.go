@@ -0,0 +1,21 @@
+package main
+
+import (
+	"net/http"
+)
+
+// upstreamTransport is shared by every client that talks to z.ai, so chat
+// requests, anonymous token fetches and pings reuse one connection pool.
+var upstreamTransport = http.DefaultTransport.(*http.Transport).Clone()
+
+// newUpstreamTransport applies the MAX_IDLE_CONNS, MAX_IDLE_CONNS_PER_HOST,
+// MAX_CONNS_PER_HOST and IDLE_CONN_TIMEOUT settings to a copy of the default
+// transport.
+func newUpstreamTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = MAX_IDLE_CONNS
+	t.MaxIdleConnsPerHost = MAX_IDLE_CONNS_PER_HOST
+	t.MaxConnsPerHost = MAX_CONNS_PER_HOST
+	t.IdleConnTimeout = IDLE_CONN_TIMEOUT
+	return t
+}
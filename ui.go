@@ -0,0 +1,153 @@
+package main
+
+import "net/http"
+
+// chatUIPage is the ENABLE_UI test page: one self-contained file that talks
+// to this proxy's own /v1/models and /v1/chat/completions with the key
+// typed into it. The key is kept in the browser's localStorage only.
+const chatUIPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>z2api test chat</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 1em auto; padding: 0 1em; }
+header { display: flex; gap: .5em; flex-wrap: wrap; align-items: center; }
+header input[type=password] { flex: 1; min-width: 12em; }
+#log { border: 1px solid #ccc; border-radius: 4px; padding: .5em; margin: 1em 0; min-height: 20em; max-height: 60vh; overflow-y: auto; }
+.msg { white-space: pre-wrap; margin: .5em 0; padding: .4em .6em; border-radius: 4px; }
+.user { background: #e8f0fe; }
+.assistant { background: #f1f3f4; }
+.error { background: #fce8e6; color: #a50e0e; }
+form { display: flex; gap: .5em; }
+textarea { flex: 1; min-height: 4em; font: inherit; }
+</style>
+</head>
+<body>
+<h1>z2api test chat</h1>
+<header>
+<input id="key" type="password" placeholder="API key" autocomplete="off">
+<button id="load" type="button">Load models</button>
+<select id="model"></select>
+<label><input id="stream" type="checkbox" checked> stream</label>
+<button id="clear" type="button">Clear</button>
+</header>
+<div id="log"></div>
+<form id="form">
+<textarea id="input" placeholder="Message (Ctrl+Enter to send)"></textarea>
+<button id="send" type="submit">Send</button>
+</form>
+<script>
+var messages = [];
+var $ = function (id) { return document.getElementById(id); };
+$("key").value = localStorage.getItem("z2api-key") || "";
+
+function headers() {
+  localStorage.setItem("z2api-key", $("key").value);
+  return { "Authorization": "Bearer " + $("key").value, "Content-Type": "application/json" };
+}
+
+function add(role, text) {
+  var div = document.createElement("div");
+  div.className = "msg " + role;
+  div.textContent = text;
+  $("log").appendChild(div);
+  $("log").scrollTop = $("log").scrollHeight;
+  return div;
+}
+
+function errorText(body, status) {
+  try { return JSON.parse(body).error.message; } catch (e) { return "HTTP " + status + ": " + body; }
+}
+
+function loadModels() {
+  fetch("/v1/models", { headers: headers() }).then(function (resp) {
+    return resp.text().then(function (body) {
+      if (!resp.ok) { throw new Error(errorText(body, resp.status)); }
+      $("model").innerHTML = "";
+      JSON.parse(body).data.forEach(function (m) {
+        var opt = document.createElement("option");
+        opt.textContent = m.id;
+        $("model").appendChild(opt);
+      });
+    });
+  }).catch(function (e) { add("error", "Loading models failed: " + e.message); });
+}
+
+function readStream(resp, div) {
+  var reader = resp.body.getReader(), decoder = new TextDecoder(), buf = "", text = "";
+  function pump() {
+    return reader.read().then(function (r) {
+      if (r.done) { return text; }
+      buf += decoder.decode(r.value, { stream: true });
+      var lines = buf.split("\n");
+      buf = lines.pop();
+      lines.forEach(function (line) {
+        if (line.indexOf("data: ") !== 0) { return; }
+        var data = line.slice(6);
+        if (data === "[DONE]") { return; }
+        var chunk = JSON.parse(data);
+        if (chunk.error) { throw new Error(chunk.error.message); }
+        var delta = chunk.choices && chunk.choices[0] && chunk.choices[0].delta;
+        if (delta && typeof delta.content === "string") {
+          text += delta.content;
+          div.textContent = text;
+          $("log").scrollTop = $("log").scrollHeight;
+        }
+      });
+      return pump();
+    });
+  }
+  return pump();
+}
+
+function send(event) {
+  event.preventDefault();
+  var content = $("input").value.trim();
+  if (!content) { return; }
+  $("input").value = "";
+  add("user", content);
+  messages.push({ role: "user", content: content });
+  var stream = $("stream").checked;
+  var div = add("assistant", "…");
+  $("send").disabled = true;
+  fetch("/v1/chat/completions", {
+    method: "POST",
+    headers: headers(),
+    body: JSON.stringify({ model: $("model").value, messages: messages, stream: stream })
+  }).then(function (resp) {
+    if (!resp.ok) {
+      return resp.text().then(function (body) { throw new Error(errorText(body, resp.status)); });
+    }
+    if (stream) { return readStream(resp, div); }
+    return resp.json().then(function (body) { return body.choices[0].message.content || ""; });
+  }).then(function (text) {
+    div.textContent = text;
+    messages.push({ role: "assistant", content: text });
+  }).catch(function (e) {
+    div.className = "msg error";
+    div.textContent = e.message;
+    messages.pop();
+  }).finally(function () { $("send").disabled = false; });
+}
+
+$("load").onclick = loadModels;
+$("clear").onclick = function () { messages = []; $("log").innerHTML = ""; };
+$("form").onsubmit = send;
+$("input").onkeydown = function (e) { if (e.key === "Enter" && e.ctrlKey) { send(e); } };
+if ($("key").value) { loadModels(); }
+</script>
+</body>
+</html>
+`
+
+// handleUI serves the ENABLE_UI test page on GET /ui.
+func handleUI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		writeError(w, http.StatusMethodNotAllowed, "Use GET to open the test UI", "invalid_request_error", "method_not_allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(chatUIPage))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// rawByteBase is where upstreamText parks bytes that are not valid UTF-8
+// while the JSON is decoded: byte b becomes rune rawByteBase+b, in the last
+// private use block, and is turned back into b afterwards.
+const rawByteBase = 0x10FF00
+
+// upstreamText is a JSON string that keeps invalid UTF-8 bytes instead of
+// replacing them with U+FFFD, so a multibyte character the upstream split
+// across two events can be put back together by utf8Carry.
+type upstreamText string
+
+func (t *upstreamText) UnmarshalJSON(b []byte) error {
+	if utf8.Valid(b) {
+		return json.Unmarshal(b, (*string)(t))
+	}
+	escaped := make([]byte, 0, len(b)+32)
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			hi, lo := utf16.EncodeRune(rawByteBase + rune(b[i]))
+			escaped = fmt.Appendf(escaped, `\u%04x\u%04x`, hi, lo)
+		} else {
+			escaped = append(escaped, b[i:i+size]...)
+		}
+		i += size
+	}
+	var s string
+	if err := json.Unmarshal(escaped, &s); err != nil {
+		return err
+	}
+	raw := make([]byte, 0, len(s))
+	for _, r := range s {
+		if r >= rawByteBase && r <= rawByteBase+0xFF {
+			raw = append(raw, byte(r-rawByteBase))
+		} else {
+			raw = utf8.AppendRune(raw, r)
+		}
+	}
+	*t = upstreamText(raw)
+	return nil
+}
+
+// utf8Carry holds back a trailing incomplete multibyte sequence until the
+// next piece of text completes it, so only valid UTF-8 reaches the client.
+type utf8Carry struct {
+	partial string
+}
+
+// push returns the complete part of the carried bytes plus s. Sequences that
+// can never become valid are replaced with U+FFFD.
+func (c *utf8Carry) push(s string) string {
+	data := c.partial + s
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i > len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRuneInString(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	c.partial = data[cut:]
+	return strings.ToValidUTF8(data[:cut], "\uFFFD")
+}
+
+// pending reports bytes still waiting for the rest of their character.
+func (c *utf8Carry) pending() int {
+	return len(c.partial)
+}
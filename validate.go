@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// requestFields are the top-level JSON fields OpenAIRequest understands.
+var requestFields = jsonFieldNames(reflect.TypeOf(OpenAIRequest{}))
+
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if field.IsExported() && name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
+
+// decodeChatRequest parses a chat completion request body. Type errors name
+// the offending field. With STRICT_REQUEST_VALIDATION, unknown top-level
+// fields and a missing or empty messages array are rejected too; otherwise
+// those are left for the upstream, as OpenAI clients often send fields this
+// proxy does not know. param is empty for a body that is not JSON at all.
+func decodeChatRequest(data []byte, req *OpenAIRequest) (param, msg string) {
+	if err := json.Unmarshal(data, req); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return typeErr.Field, fmt.Sprintf("%s must be %s, got %s", typeErr.Field, jsonTypeName(typeErr.Type), typeErr.Value)
+		}
+		return "", "Invalid JSON"
+	}
+	if !STRICT_REQUEST_VALIDATION {
+		return "", ""
+	}
+	var fields map[string]json.RawMessage
+	json.Unmarshal(data, &fields)
+	var unknown []string
+	for name := range fields {
+		if !requestFields[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return unknown[0], fmt.Sprintf("Unrecognized request argument supplied: %s", strings.Join(unknown, ", "))
+	}
+	if len(req.Messages) == 0 {
+		return "messages", "messages must be a non-empty array"
+	}
+	return "", ""
+}
+
+// writeDecodeError reports a decodeChatRequest failure.
+func writeDecodeError(w http.ResponseWriter, param, msg string) {
+	if param == "" {
+		writeError(w, http.StatusBadRequest, msg, "invalid_request_error", "")
+		return
+	}
+	writeInvalidParam(w, param, msg)
+}
+
+// jsonTypeName describes a Go type in JSON terms for error messages.
+func jsonTypeName(t reflect.Type) string {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return "a " + t.String()
+}
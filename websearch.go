@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// webSearchToolTypes are the tool types that ask for the upstream's built-in
+// web search instead of a client-side function.
+var webSearchToolTypes = []string{"web_search", "web_search_preview"}
+
+// takeWebSearchTool moves a web search tool out of req.Tools into
+// req.WebSearch, since the upstream enables search with a feature flag
+// rather than a tool.
+func takeWebSearchTool(req *OpenAIRequest) {
+	kept := req.Tools[:0]
+	for _, tool := range req.Tools {
+		var t struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(tool, &t) == nil && contains(webSearchToolTypes, t.Type) {
+			req.WebSearch = true
+			continue
+		}
+		kept = append(kept, tool)
+	}
+	req.Tools = kept
+}
+
+// Citation is one search result the upstream used for its answer.
+type Citation struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// glmBlockPattern matches the <glm_block> elements in which z.ai reports
+// tool activity, such as search results, during the tool_call phase.
+var glmBlockPattern = regexp.MustCompile(`(?s)<glm_block[^>]*>(.*?)</glm_block>`)
+
+// collectCitations buffers tool_call content and records the search results
+// of every complete <glm_block> in it.
+func (t *translator) collectCitations(ev *UpstreamData) {
+	t.searchBuf += string(ev.Data.DeltaContent) + ev.Data.EditContent
+	for {
+		loc := glmBlockPattern.FindStringSubmatchIndex(t.searchBuf)
+		if loc == nil {
+			return
+		}
+		var block interface{}
+		if err := json.Unmarshal([]byte(t.searchBuf[loc[2]:loc[3]]), &block); err != nil {
+			debugLog("Skipping unparsable glm_block: %v", err)
+		}
+		for _, c := range findCitations(block) {
+			if !t.hasCitation(c.URL) {
+				t.citations = append(t.citations, c)
+			}
+		}
+		t.searchBuf = t.searchBuf[loc[1]:]
+	}
+}
+
+func (t *translator) hasCitation(url string) bool {
+	for _, c := range t.citations {
+		if c.URL == url {
+			return true
+		}
+	}
+	return false
+}
+
+// findCitations walks a decoded glm_block for objects with a url, which is
+// how the upstream lists search results (under data.metadata.result).
+func findCitations(v interface{}) []Citation {
+	var found []Citation
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if url, ok := v["url"].(string); ok && strings.HasPrefix(url, "http") {
+			title, _ := v["title"].(string)
+			return []Citation{{Title: title, URL: url}}
+		}
+		for _, child := range v {
+			found = append(found, findCitations(child)...)
+		}
+	case []interface{}:
+		for _, child := range v {
+			found = append(found, findCitations(child)...)
+		}
+	}
+	return found
+}
+
+// Annotation is an OpenAI message annotation. Only url_citation is
+// produced.
+type Annotation struct {
+	Type        string       `json:"type"`
+	URLCitation *URLCitation `json:"url_citation,omitempty"`
+}
+
+// URLCitation locates a cited source in the message content; the indexes
+// count characters.
+type URLCitation struct {
+	StartIndex int    `json:"start_index"`
+	EndIndex   int    `json:"end_index"`
+	URL        string `json:"url"`
+	Title      string `json:"title"`
+}
+
+// citationReferences renders citations as a numbered list to append after
+// the answer, which starts offset characters into the content, with a
+// url_citation annotation spanning each entry of the list.
+func citationReferences(citations []Citation, offset int) (string, []Annotation) {
+	var b strings.Builder
+	b.WriteString("\n\n")
+	annotations := make([]Annotation, 0, len(citations))
+	for i, c := range citations {
+		title := c.Title
+		if title == "" {
+			title = c.URL
+		}
+		start := offset + utf8.RuneCountInString(b.String())
+		line := fmt.Sprintf("[%d] [%s](%s)", i+1, title, c.URL)
+		b.WriteString(line + "\n")
+		annotations = append(annotations, Annotation{Type: "url_citation", URLCitation: &URLCitation{
+			StartIndex: start,
+			EndIndex:   start + utf8.RuneCountInString(line),
+			URL:        c.URL,
+			Title:      c.Title,
+		}})
+	}
+	return b.String(), annotations
+}
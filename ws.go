@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WebSocket opcodes and close codes used here (RFC 6455).
+const (
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+
+	wsCloseNormal   = 1000
+	wsCloseTooLarge = 1009
+
+	wsAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	// wsMaxMessageBytes bounds the request message a client may send.
+	wsMaxMessageBytes = 16 << 20
+	// wsRequestTimeout is how long a client has to send its request after
+	// the handshake.
+	wsRequestTimeout = 30 * time.Second
+)
+
+var errWSTooLarge = errors.New("websocket message too large")
+
+// handleChatCompletionsWS serves a chat completion over a WebSocket: the
+// first text message is the OpenAI request, and each chunk the SSE stream
+// would carry is sent back as a text frame, ending with "[DONE]". Browsers
+// cannot set Authorization on a WebSocket, so the key may also be given as
+// ?api_key=.
+func handleChatCompletionsWS(w http.ResponseWriter, r *http.Request) {
+	setCORSHeaders(w)
+	if r.Method != http.MethodGet || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		w.Header().Set("Upgrade", "websocket")
+		writeError(w, http.StatusUpgradeRequired, "this endpoint only accepts WebSocket connections", "invalid_request_error", "")
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeError(w, http.StatusBadRequest, "invalid WebSocket handshake", "invalid_request_error", "")
+		return
+	}
+	if r.Header.Get("Authorization") == "" {
+		if apiKey := r.URL.Query().Get("api_key"); apiKey != "" {
+			r.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+	}
+	apiKey, ok := authenticate(w, r)
+	if !ok {
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "WebSocket is not supported by this server", "server_error", "")
+		return
+	}
+	defer conn.Close()
+	sum := sha1.Sum([]byte(key + wsAcceptGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	ws := &wsConn{conn: conn, rw: rw}
+
+	conn.SetReadDeadline(time.Now().Add(wsRequestTimeout))
+	message, err := ws.readMessage()
+	if err != nil {
+		if errors.Is(err, errWSTooLarge) {
+			ws.close(wsCloseTooLarge)
+		}
+		debugLog("WebSocket closed before a request arrived: %v", err)
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// The connection carries a single completion; anything the client sends
+	// afterwards is only watched for a close. That cancels ctx, which
+	// completeChat hands to the upstream call as req.ctx; req.webSocket keeps
+	// SSE_RESUME from detaching it, as a WebSocket client cannot resume.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		defer cancel()
+		for {
+			if _, err := ws.readMessage(); err != nil {
+				ws.closed.Store(true)
+				return
+			}
+		}
+	}()
+
+	out := &wsResponseWriter{ws: ws, header: http.Header{}, status: http.StatusOK}
+	var req OpenAIRequest
+	if param, msg := decodeChatRequest(message, &req); msg != "" {
+		writeDecodeError(out, param, msg)
+	} else {
+		stream := true
+		req.Stream = &stream
+		req.webSocket = true
+		completeChat(out, r.WithContext(ctx), apiKey, &req)
+	}
+	out.finish()
+	ws.close(wsCloseNormal)
+}
+
+// wsConn reads and writes frames on a hijacked connection. Writes are
+// serialized so pongs can interleave with completion chunks.
+type wsConn struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	mu     sync.Mutex
+	closed atomic.Bool
+}
+
+// readMessage returns the next data message, reassembling fragments and
+// answering pings. A close frame is echoed and reported as io.EOF.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case wsOpPing:
+			c.writeFrame(wsOpPong, payload)
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.mu.Lock()
+			c.writeFrameLocked(wsOpClose, payload)
+			c.mu.Unlock()
+			c.closed.Store(true)
+			return nil, io.EOF
+		}
+		message = append(message, payload...)
+		if len(message) > wsMaxMessageBytes {
+			return nil, errWSTooLarge
+		}
+		if fin {
+			return message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var head [2]byte
+	if _, err = io.ReadFull(c.rw, head[:]); err != nil {
+		return
+	}
+	fin, opcode = head[0]&0x80 != 0, head[0]&0x0F
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.rw, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > wsMaxMessageBytes {
+		err = errWSTooLarge
+		return
+	}
+	if !masked {
+		err = errors.New("client frame is not masked")
+		return
+	}
+	var mask [4]byte
+	if _, err = io.ReadFull(c.rw, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.rw, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed.Load() {
+		return net.ErrClosed
+	}
+	return c.writeFrameLocked(opcode, payload)
+}
+
+func (c *wsConn) writeFrameLocked(opcode byte, payload []byte) error {
+	head := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		head = append(head, byte(n))
+	case n <= 0xFFFF:
+		head = append(head, 126)
+		head = binary.BigEndian.AppendUint16(head, uint16(n))
+	default:
+		head = append(head, 127)
+		head = binary.BigEndian.AppendUint64(head, uint64(n))
+	}
+	c.rw.Write(head)
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+// close sends a close frame unless the client already closed.
+func (c *wsConn) close(code uint16) {
+	c.writeFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, code))
+	c.closed.Store(true)
+}
+
+// wsResponseWriter turns what the handlers write into WebSocket frames: each
+// SSE event's data becomes a text frame, and any other body (an error reply)
+// is sent as one frame once the handler returns.
+type wsResponseWriter struct {
+	ws     *wsConn
+	header http.Header
+	status int
+	buf    []byte
+}
+
+func (w *wsResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *wsResponseWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *wsResponseWriter) Write(p []byte) (int, error) {
+	if w.ws.closed.Load() {
+		return 0, net.ErrClosed
+	}
+	w.buf = append(w.buf, p...)
+	if !strings.HasPrefix(w.header.Get("Content-Type"), "text/event-stream") {
+		return len(p), nil
+	}
+	for {
+		w.buf = bytes.TrimLeft(w.buf, "\n")
+		event, rest, ok := bytes.Cut(w.buf, []byte("\n\n"))
+		if !ok {
+			return len(p), nil
+		}
+		w.buf = rest
+		if data := sseData(event); data != nil {
+			if err := w.ws.writeFrame(wsOpText, data); err != nil {
+				return 0, err
+			}
+		}
+	}
+}
+
+// Flush is a no-op: every complete event is sent as soon as it is written.
+func (w *wsResponseWriter) Flush() {}
+
+// finish sends a buffered non-stream body, such as an error reply.
+func (w *wsResponseWriter) finish() {
+	if body := bytes.TrimSpace(w.buf); len(body) > 0 && !strings.HasPrefix(w.header.Get("Content-Type"), "text/event-stream") {
+		w.ws.writeFrame(wsOpText, body)
+	}
+}
+
+// sseData joins the data lines of one SSE event, or returns nil for events
+// without data such as keepalive comments.
+func sseData(event []byte) []byte {
+	var data [][]byte
+	for _, line := range bytes.Split(event, []byte("\n")) {
+		if value, ok := bytes.CutPrefix(line, []byte("data:")); ok {
+			data = append(data, bytes.TrimPrefix(value, []byte(" ")))
+		}
+	}
+	if data == nil {
+		return nil
+	}
+	return bytes.Join(data, []byte("\n"))
+}